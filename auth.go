@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/urfave/cli/v2"
+)
+
+// jwtPayload is the claim carried by API tokens, as in lotus.
+type jwtPayload struct {
+	Allow []auth.Permission
+}
+
+func secretPath(root string) string {
+	return path.Join(root, "jwt-secret")
+}
+
+// loadSecret reads the key API tokens and sector URLs are signed with from the
+// store, creating one if there isn't one yet.
+func loadSecret(root string) ([]byte, error) {
+	b, err := os.ReadFile(secretPath(root))
+	if errors.Is(err, os.ErrNotExist) {
+		b = make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(secretPath(root), b); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// createToken returns a token granting perm and the permissions below it.
+func createToken(secret []byte, perm auth.Permission) ([]byte, error) {
+	for i, p := range api.AllPermissions {
+		if p == perm {
+			return jwt.Sign(&jwtPayload{Allow: api.AllPermissions[:i+1]}, jwt.NewHS256(secret))
+		}
+	}
+	return nil, fmt.Errorf("unknown permission %q, must be one of %v", perm, api.AllPermissions)
+}
+
+// authHandler checks the token of each request, so RPC methods can check the
+// caller's permissions. Requests without a token only get read permission.
+func authHandler(secret []byte, next http.Handler) http.Handler {
+	hs := jwt.NewHS256(secret)
+	return &auth.Handler{
+		Verify: func(ctx context.Context, token string) ([]auth.Permission, error) {
+			var payload jwtPayload
+			if _, err := jwt.Verify([]byte(token), hs, &payload); err != nil {
+				return nil, fmt.Errorf("invalid token: %w", err)
+			}
+			return payload.Allow, nil
+		},
+		Next: next.ServeHTTP,
+	}
+}
+
+// permissioned fills the methods of out, a lotus API struct, from the first
+// of impls implementing each, guarded by the permission lotus requires for it.
+// Calls are counted and timed. A method of the same name as one of out's, but
+// with a different signature, is an error rather than being left out.
+func permissioned(out interface{}, impls ...interface{}) error {
+	for _, internal := range api.GetInternalStructs(out) {
+		rint := reflect.ValueOf(internal).Elem()
+		for i := 0; i < rint.NumField(); i++ {
+			field := rint.Type().Field(i)
+			var fn reflect.Value
+			for _, impl := range impls {
+				m := reflect.ValueOf(impl).MethodByName(field.Name)
+				if !m.IsValid() {
+					continue
+				}
+				if m.Type() != field.Type {
+					return fmt.Errorf("%T.%s is %s, but the lotus API has %s", impl, field.Name, m.Type(), field.Type)
+				}
+				fn = m
+				break
+			}
+			if !fn.IsValid() {
+				continue
+			}
+
+			name, perm := field.Name, auth.Permission(field.Tag.Get("perm"))
+			rint.Field(i).Set(reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+				ctx := args[0].Interface().(context.Context)
+				log := requestLogger(ctx, rpcLog).With("method", name)
+				if auth.HasPerm(ctx, api.DefaultPerms, perm) {
+					start := time.Now()
+					res := fn.Call(args)
+					outcome := errorOutcome(res)
+					rpcDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+					rpcCalls.WithLabelValues(name, outcome).Inc()
+					if outcome == "ok" {
+						log.Debugw("call", "outcome", outcome, "duration", time.Since(start))
+					} else {
+						log.Warnw("call", "outcome", outcome, "duration", time.Since(start), "error", res[len(res)-1].Interface())
+					}
+					return res
+				}
+				rpcCalls.WithLabelValues(name, "denied").Inc()
+				log.Warnw("call", "outcome", "denied", "need", perm)
+				err := fmt.Errorf("missing permission to invoke '%s' (need '%s')", name, perm)
+				out := []reflect.Value{reflect.ValueOf(&err).Elem()}
+				if field.Type.NumOut() == 2 {
+					out = append([]reflect.Value{reflect.Zero(field.Type.Out(0))}, out...)
+				}
+				return out
+			}))
+		}
+	}
+	return nil
+}
+
+// signPath returns p with a signature letting it be fetched without a token until expires.
+func signPath(secret []byte, p string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return p + "?" + url.Values{"expires": {exp}, "sig": {pathSignature(secret, p, exp)}}.Encode()
+}
+
+func pathSignature(secret []byte, p, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "sector url\n%s\n%s", p, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedRequest checks r carries a valid signature for its path that hasn't expired.
+func signedRequest(secret []byte, r *http.Request) bool {
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(q.Get("sig")), []byte(pathSignature(secret, r.URL.Path, q.Get("expires"))))
+}
+
+// sectorAuth admits requests for sector data with admin permission, as the
+// lotus storage handler does, or with a signed URL.
+func sectorAuth(secret []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.HasPerm(r.Context(), nil, api.PermAdmin) && !signedRequest(secret, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePerm admits only requests with perm.
+func requirePerm(perm auth.Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.HasPerm(r.Context(), nil, perm) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var authCmd = &cli.Command{
+	Name:  "auth",
+	Usage: "manage API tokens",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "create-token",
+			Usage: "create a token for the JSON-RPC API",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "perm",
+					Usage: "permission to grant: read, write, sign or admin. Each includes the ones before it",
+					Value: string(api.PermRead),
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				store, err := openStore(cctx)
+				if err != nil {
+					return err
+				}
+				secret, err := loadSecret(store.root)
+				if err != nil {
+					return err
+				}
+				token, err := createToken(secret, auth.Permission(cctx.String("perm")))
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(token))
+				return nil
+			},
+		},
+		{
+			Name:  "api-info",
+			Usage: "print FULLNODE_API_INFO and MINER_API_INFO for connecting boost",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "perm",
+					Usage: "permission to grant: read, write, sign or admin",
+					Value: string(api.PermAdmin),
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				store, err := openStore(cctx)
+				if err != nil {
+					return err
+				}
+				secret, err := loadSecret(store.root)
+				if err != nil {
+					return err
+				}
+				token, err := createToken(secret, auth.Permission(cctx.String("perm")))
+				if err != nil {
+					return err
+				}
+				addr, err := apiInfo(cctx)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("FULLNODE_API_INFO=%s:%s\n", token, addr)
+				fmt.Printf("MINER_API_INFO=%s:%s\n", token, addr)
+				return nil
+			},
+		},
+		{
+			Name:      "sign-url",
+			Usage:     "create a download link for a piece that needs no token",
+			ArgsUsage: "<sector number|piece CID>",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "expires",
+					Usage: "how long the link is valid for",
+					Value: 24 * time.Hour,
+				},
+				&cli.StringFlag{
+					Name:  "miner",
+					Usage: "miner holding the piece, if not the primary one",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if cctx.NArg() != 1 {
+					return fmt.Errorf("expected a sector number or piece CID")
+				}
+				root := cctx.String("root")
+				secret, err := loadSecret(root)
+				if err != nil {
+					return err
+				}
+				storeRoot, prefix := root, ""
+				if cctx.IsSet("miner") {
+					a, err := address.NewFromString(cctx.String("miner"))
+					if err != nil {
+						return fmt.Errorf("--miner: %w", err)
+					}
+					primary, err := readIdentity(root)
+					if err != nil {
+						return err
+					}
+					if primary == nil || a != primary.Actor {
+						storeRoot, prefix = path.Join(minersDir(root), a.String()), "/"+a.String()
+						if _, err := os.Stat(storeRoot); err != nil {
+							return fmt.Errorf("miner %s is not hosted in %s", a, root)
+						}
+					}
+				}
+				store, err := openStoreAt(cctx, storeRoot)
+				if err != nil {
+					return err
+				}
+				n, err := store.findPiece(cctx.Args().First())
+				if err != nil {
+					return err
+				}
+				p := signPath(secret, fmt.Sprintf("/sector%s/%d", prefix, n), time.Now().Add(cctx.Duration("expires")))
+				fmt.Println(publicURL(cctx) + p)
+				return nil
+			},
+		},
+	},
+}
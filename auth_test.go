@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api"
+)
+
+type versionImpl struct{}
+
+func (versionImpl) Version(ctx context.Context) (api.APIVersion, error) {
+	return api.APIVersion{Version: "test"}, nil
+}
+
+func (versionImpl) WalletDelete(ctx context.Context, a address.Address) error {
+	return nil
+}
+
+// walletSignImpl has the WalletSign of the remote wallet API, not the full node one.
+type walletSignImpl struct{}
+
+func (walletSignImpl) WalletSign(ctx context.Context, a address.Address, b []byte, meta api.MsgMeta) error {
+	return nil
+}
+
+func TestPermissioned(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		impls []interface{}
+		ok    bool
+	}{
+		{"matching methods", []interface{}{versionImpl{}}, true},
+		{"mismatched signature", []interface{}{versionImpl{}, walletSignImpl{}}, false},
+		{"storage handler", []interface{}{&StorageHandler{}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := permissioned(&api.FullNodeStruct{}, tc.impls...); (err == nil) != tc.ok {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+	if err := permissioned(&api.StorageMinerStruct{}, &StorageHandler{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var full api.FullNodeStruct
+	if err := permissioned(&full, versionImpl{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := full.Version(context.Background()); err != nil || v.Version != "test" {
+		t.Fatalf("read method without a token: %v, %v", v, err)
+	}
+	a, _ := address.NewIDAddress(1000)
+	if err := full.WalletDelete(context.Background(), a); err == nil {
+		t.Fatal("admin method called without a token")
+	}
+	ctx := auth.WithPerm(context.Background(), api.AllPermissions)
+	if err := full.WalletDelete(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := full.WalletNew(ctx, "secp256k1"); err == nil {
+		t.Fatal("unimplemented method succeeded")
+	}
+}
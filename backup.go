@@ -0,0 +1,355 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const backupVersion = 1
+
+// backupManifest describes the contents of a backup archive.
+// It is the last entry in the archive so checksums can be computed while streaming.
+type backupManifest struct {
+	Version int
+	Created time.Time
+	Since   uint64
+	N       uint64
+	// Next is the --since for the next incremental backup: the lowest sector
+	// with neither metadata nor a quarantine entry when this one was taken, as
+	// it may still be being written, or else N.
+	Next         uint64
+	MetadataOnly bool
+	Sectors      map[uint64]backupSector
+}
+
+type backupSector struct {
+	Size   int64
+	SHA256 string `json:",omitempty"`
+}
+
+var backupCmd = &cli.Command{
+	Name:  "backup",
+	Usage: "write a consistent snapshot of the store to a tar archive",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "out",
+			Aliases:  []string{"o"},
+			Usage:    "archive to write, or - for stdout",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "metadata-only",
+			Usage: "only capture the index, not piece data",
+		},
+		&cli.Uint64Flag{
+			Name:  "since",
+			Usage: "only include sectors numbered at or above this (for incremental backups)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		store, err := openStore(cctx)
+		if err != nil {
+			return err
+		}
+
+		var out io.Writer = os.Stdout
+		if cctx.String("out") != "-" {
+			fi, err := os.OpenFile(cctx.String("out"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			out = fi
+		}
+
+		m, err := store.Backup(out, cctx.Uint64("since"), !cctx.Bool("metadata-only"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d sectors [%d, %d); use --since %d for the next incremental backup\n", len(m.Sectors), m.Since, m.N, m.Next)
+		return nil
+	},
+}
+
+var restoreCmd = &cli.Command{
+	Name:      "restore",
+	Usage:     "restore backup archives into a fresh store root",
+	ArgsUsage: "<base archive> [incremental archives...]",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() == 0 {
+			return fmt.Errorf("no archives provided")
+		}
+		store, err := openStore(cctx)
+		if err != nil {
+			return err
+		}
+		if store.i.N != 0 {
+			return fmt.Errorf("refusing to restore into non-empty store at %s", store.root)
+		}
+
+		for _, a := range cctx.Args().Slice() {
+			fi, err := os.Open(a)
+			if err != nil {
+				return err
+			}
+			m, err := store.Restore(cctx.Context, fi)
+			fi.Close()
+			if err != nil {
+				return fmt.Errorf("restoring %s: %w", a, err)
+			}
+			fmt.Fprintf(os.Stderr, "restored %d sectors [%d, %d) from %s\n", len(m.Sectors), m.Since, m.N, a)
+		}
+		return nil
+	},
+}
+
+// Backup writes sectors numbered `since` and above to w as a tar archive.
+// Only sectors with metadata in the index are included; those are complete on disk.
+// Quarantined sectors are always recorded, so they stay out of service when restored.
+func (f *filestore) Backup(w io.Writer, since uint64, withData bool) (*backupManifest, error) {
+	i := f.snapshot()
+	// uploads may be in progress in another process, so sectors still being
+	// written are told apart by the index alone.
+	next := uint64(0)
+	for next < i.N {
+		_, done := i.Metadata[next]
+		_, quarantined := i.Quarantine[next]
+		if !done && !quarantined {
+			break
+		}
+		next++
+	}
+
+	m := backupManifest{
+		Version:      backupVersion,
+		Created:      time.Now(),
+		Since:        since,
+		N:            i.N,
+		Next:         next,
+		MetadataOnly: !withData,
+		Sectors:      make(map[uint64]backupSector),
+	}
+
+	tw := tar.NewWriter(w)
+	for n := range i.Metadata {
+		if n < since {
+			delete(i.Metadata, n)
+			continue
+		}
+		stat, err := os.Stat(f.sectorPath(n))
+		if err != nil {
+			return nil, err
+		}
+		bs := backupSector{Size: stat.Size()}
+		if withData {
+			if bs.SHA256, err = writeTarFile(tw, f.sectorPath(n), fmt.Sprintf("sectors/%d.sector", n), stat.Size()); err != nil {
+				return nil, err
+			}
+		}
+		m.Sectors[n] = bs
+
+		if stat, err := os.Stat(f.metaPath(n)); err == nil {
+			if _, err := writeTarFile(tw, f.metaPath(n), fmt.Sprintf("sectors/%d.meta", n), stat.Size()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := writeTarJSON(tw, "index", i); err != nil {
+		return nil, err
+	}
+	if err := writeTarJSON(tw, "manifest.json", m); err != nil {
+		return nil, err
+	}
+	return &m, tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, src, name string, size int64) (string, error) {
+	fi, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0660, Size: size, ModTime: time.Now()}); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(io.LimitReader(fi, size), h)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeTarJSON(tw *tar.Writer, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0660, Size: int64(len(b)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// Restore applies a backup archive on top of the store. Piece data is staged
+// and only moved into place once it matches the manifest, so a failed restore
+// leaves the index untouched.
+func (f *filestore) Restore(ctx context.Context, r io.Reader) (*backupManifest, error) {
+	staging := path.Join(f.root, ".restore")
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(staging, 0770); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	var m *backupManifest
+	var i *index
+	sums := make(map[uint64]backupSector)
+	sidecars := make(map[uint64]*sectorMeta)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case hdr.Name == "manifest.json":
+			m = &backupManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, err
+			}
+		case hdr.Name == "index":
+			i = &index{}
+			if err := json.NewDecoder(tr).Decode(i); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(hdr.Name, "sectors/") && strings.HasSuffix(hdr.Name, ".meta"):
+			var n uint64
+			if _, err := fmt.Sscanf(path.Base(hdr.Name), "%d.meta", &n); err != nil {
+				return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+			}
+			sm := &sectorMeta{}
+			if err := json.NewDecoder(tr).Decode(sm); err != nil {
+				return nil, err
+			}
+			sidecars[n] = sm
+		case strings.HasPrefix(hdr.Name, "sectors/"):
+			var n uint64
+			if _, err := fmt.Sscanf(path.Base(hdr.Name), "%d.sector", &n); err != nil {
+				return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+			}
+			fi, err := os.OpenFile(path.Join(staging, path.Base(hdr.Name)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.New()
+			size, err := io.Copy(io.MultiWriter(fi, h), tr)
+			fi.Close()
+			if err != nil {
+				return nil, err
+			}
+			sums[n] = backupSector{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+		default:
+			return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+		}
+	}
+
+	if m == nil || i == nil {
+		return nil, fmt.Errorf("archive is missing its manifest or index")
+	}
+	if m.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if m.Since > f.i.N {
+		return nil, fmt.Errorf("archive starts at sector %d, but the store only has %d sectors", m.Since, f.i.N)
+	}
+	for n := range i.Metadata {
+		if n < m.Since || n >= m.N {
+			return nil, fmt.Errorf("index entry for sector %d is outside the archive range [%d, %d)", n, m.Since, m.N)
+		}
+		if _, ok := m.Sectors[n]; !ok {
+			return nil, fmt.Errorf("sector %d has metadata but is not in the manifest", n)
+		}
+	}
+	for n, bs := range m.Sectors {
+		if _, ok := i.Metadata[n]; !ok {
+			return nil, fmt.Errorf("sector %d is in the manifest but has no metadata", n)
+		}
+		if m.MetadataOnly {
+			continue
+		}
+		if sums[n] != bs {
+			return nil, fmt.Errorf("sector %d does not match its checksum", n)
+		}
+	}
+	for n := range sums {
+		if _, ok := m.Sectors[n]; !ok || m.MetadataOnly {
+			return nil, fmt.Errorf("unexpected piece data for sector %d", n)
+		}
+	}
+	for n := range sidecars {
+		if _, ok := m.Sectors[n]; !ok {
+			return nil, fmt.Errorf("unexpected sidecar for sector %d", n)
+		}
+	}
+	for n := range i.Quarantine {
+		if _, ok := i.Metadata[n]; ok {
+			return nil, fmt.Errorf("sector %d is both quarantined and in service", n)
+		}
+		if n >= m.N {
+			return nil, fmt.Errorf("quarantined sector %d is outside the archive range [0, %d)", n, m.N)
+		}
+	}
+
+	for n := range sums {
+		if err := os.Rename(path.Join(staging, fmt.Sprintf("%d.sector", n)), f.sectorPath(n)); err != nil {
+			return nil, err
+		}
+	}
+	for n, sm := range sidecars {
+		if err := f.writeSidecar(n, sm); err != nil {
+			return nil, err
+		}
+	}
+	for n, md := range i.Metadata {
+		f.i.Metadata[n] = md
+	}
+	// sectors quarantined since an earlier archive was taken are taken out of service again.
+	for n, q := range i.Quarantine {
+		if _, ok := f.i.Metadata[n]; ok {
+			if err := f.moveToQuarantine(n); err != nil {
+				return nil, err
+			}
+			delete(f.i.Metadata, n)
+		}
+		f.i.Quarantine[n] = q
+	}
+	if m.N > f.i.N {
+		f.i.N = m.N
+	}
+	return m, f.saveIndex(ctx)
+}
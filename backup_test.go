@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src, _ := newFilledStore(t, nil, 1, 2, 3)
+	dst := restored(t, backupOf(t, src, 0, true))
+	assertRestored(t, src, dst, true)
+}
+
+func TestBackupMetadataOnly(t *testing.T) {
+	src, _ := newFilledStore(t, nil, 1, 2)
+	dst := restored(t, backupOf(t, src, 0, false))
+	assertRestored(t, src, dst, false)
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	src, _ := newFilledStore(t, nil, 1, 2)
+	base := backupOf(t, src, 0, true)
+	addTestPieces(t, src, 3)
+	incr := backupOf(t, src, 2, true)
+
+	dst := restored(t, base, incr)
+	assertRestored(t, src, dst, true)
+}
+
+func TestIncrementalBackupKeepsQuarantine(t *testing.T) {
+	src, s := newFilledStore(t, nil, 1, 2, 3)
+	base := backupOf(t, src, 0, true)
+	if err := src.Quarantine(context.Background(), s[1], "bad"); err != nil {
+		t.Fatal(err)
+	}
+	incr := backupOf(t, src, 3, true)
+
+	// the base archive still has the sector, but it stays out of service.
+	dst := restored(t, base, incr)
+	assertRestored(t, src, dst, true)
+	if _, err := os.Stat(dst.sectorPath(s[1])); err == nil {
+		t.Errorf("quarantined sector %d is still in place", s[1])
+	}
+}
+
+// restored returns a new store with archives restored into it, in order.
+func restored(t *testing.T, archives ...[]byte) *filestore {
+	t.Helper()
+	dst := newTestStore(t)
+	for _, a := range archives {
+		if _, err := dst.Restore(context.Background(), bytes.NewReader(a)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+// assertRestored checks dst has the index of src, and its sector data if withData is set.
+func assertRestored(t *testing.T, src, dst *filestore, withData bool) {
+	t.Helper()
+	// deals are compared as the index stores them.
+	got, _ := json.Marshal(dst.snapshot())
+	want, _ := json.Marshal(src.snapshot())
+	if !bytes.Equal(got, want) {
+		t.Fatalf("restored index %s, want %s", got, want)
+	}
+	for n := range src.i.Metadata {
+		_, err := os.Stat(dst.sectorPath(n))
+		if !withData {
+			if err == nil {
+				t.Errorf("sector %d has data in a metadata-only restore", n)
+			}
+			continue
+		}
+		want, _ := os.ReadFile(src.sectorPath(n))
+		got, err := os.ReadFile(dst.sectorPath(n))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("sector %d data differs after restore: %v", n, err)
+		}
+	}
+}
+
+// blockingReader reads r once release is closed, closing started on the first read.
+type blockingReader struct {
+	r       io.Reader
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	b.once.Do(func() { close(b.started) })
+	<-b.release
+	return b.r.Read(p)
+}
+
+func TestBackupNextCoversUploadsInProgress(t *testing.T) {
+	f, _ := newFilledStore(t, nil, 1)
+
+	data, md := testPiece(t, 2)
+	r := &blockingReader{r: bytes.NewReader(data), started: make(chan struct{}), release: make(chan struct{})}
+	added := make(chan error)
+	go func() {
+		_, err := f.Add(context.Background(), r, md)
+		added <- err
+	}()
+	<-r.started
+
+	// the backup command opens the store in a process of its own.
+	other, err := NewStore(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := other.Backup(&bytes.Buffer{}, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.N != 2 || m.Next != 1 {
+		t.Fatalf("N, Next = %d, %d with sector 1 being written, want 2, 1", m.N, m.Next)
+	}
+	if _, ok := m.Sectors[1]; ok {
+		t.Fatal("the base backup has sector 1 while it is being written")
+	}
+
+	close(r.release)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	other, err = NewStore(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = other.Backup(&bytes.Buffer{}, m.Next, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Sectors[1]; !ok || m.Next != 2 {
+		t.Fatalf("the next backup has sectors %v and Next %d, want sector 1 and 2", m.Sectors, m.Next)
+	}
+}
+
+func TestRestoreRejectsTamperedData(t *testing.T) {
+	f, _ := newFilledStore(t, nil, 1)
+	a := backupOf(t, f, 0, true)
+
+	data, _ := testPiece(t, 1)
+	i := bytes.Index(a, data[:64])
+	if i < 0 {
+		t.Fatal("piece data not found in archive")
+	}
+	a[i] ^= 0xff
+
+	dst := newTestStore(t)
+	if _, err := dst.Restore(context.Background(), bytes.NewReader(a)); err == nil {
+		t.Fatal("restored an archive with corrupt piece data")
+	}
+	if len(dst.i.Metadata) != 0 {
+		t.Fatalf("failed restore left %d sectors in the index", len(dst.i.Metadata))
+	}
+}
+
+func backupOf(t *testing.T, f *filestore, since uint64, withData bool) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := f.Backup(&b, since, withData); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
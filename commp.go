@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+// pieceCID computes the CommP of the unpadded piece data in r, padded out to
+// the deal's piece size.
+func pieceCID(r io.Reader, size abi.PaddedPieceSize) (cid.Cid, error) {
+	cp := &commp.Calc{}
+	if _, err := io.Copy(cp, r); err != nil {
+		return cid.Undef, err
+	}
+	return digestCID(cp, size)
+}
+
+// digestCID finishes a CommP calculation, padding it out to the deal's piece size.
+func digestCID(cp *commp.Calc, size abi.PaddedPieceSize) (cid.Cid, error) {
+	raw, paddedSize, err := cp.Digest()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if paddedSize < uint64(size) {
+		if raw, err = commp.PadCommP(raw, paddedSize, uint64(size)); err != nil {
+			return cid.Undef, err
+		}
+	} else if paddedSize > uint64(size) {
+		return cid.Undef, fmt.Errorf("piece data (%d padded) exceeds piece size %d", paddedSize, size)
+	}
+	return commcid.DataCommitmentV1ToCID(raw)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/DataDog/zstd"
+	"github.com/urfave/cli/v2"
+)
+
+// Pieces are compressed in the zstd seekable format: independently compressed
+// frames followed by a skippable frame holding a table of frame sizes, so a
+// range can be read by decompressing only the frames it overlaps.
+// See https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+const (
+	encodingZstdSeekable = "zstd-seekable"
+
+	seekableFrameSize   = 1 << 20
+	seekableMagic       = 0x8F92EAB1
+	skippableFrameMagic = 0x184D2A5E
+	seekTableFooterSize = 9
+)
+
+type seekEntry struct {
+	compressed   uint32
+	decompressed uint32
+}
+
+// seekableWriter compresses everything written to it into fixed size frames.
+// Close must be called to write the seek table.
+type seekableWriter struct {
+	w       io.Writer
+	buf     []byte
+	entries []seekEntry
+}
+
+func newSeekableWriter(w io.Writer) *seekableWriter {
+	return &seekableWriter{w: w, buf: make([]byte, 0, seekableFrameSize)}
+}
+
+func (s *seekableWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *seekableWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	frame, err := zstd.Compress(nil, s.buf)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, seekEntry{uint32(len(frame)), uint32(len(s.buf))})
+	s.buf = s.buf[:0]
+	return nil
+}
+
+func (s *seekableWriter) Close() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	table := make([]byte, 8+8*len(s.entries)+seekTableFooterSize)
+	binary.LittleEndian.PutUint32(table[0:], skippableFrameMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(len(table)-8))
+	for i, e := range s.entries {
+		binary.LittleEndian.PutUint32(table[8+8*i:], e.compressed)
+		binary.LittleEndian.PutUint32(table[12+8*i:], e.decompressed)
+	}
+	footer := table[len(table)-seekTableFooterSize:]
+	binary.LittleEndian.PutUint32(footer[0:], uint32(len(s.entries)))
+	footer[4] = 0
+	binary.LittleEndian.PutUint32(footer[5:], seekableMagic)
+	_, err := s.w.Write(table)
+	return err
+}
+
+// seekableReader gives random access to the decompressed contents of a seekable zstd stream.
+type seekableReader struct {
+	r io.ReaderAt
+	// compressed and decompressed offsets of each frame, with a trailing entry for the end.
+	offsets []int64
+	starts  []int64
+
+	l      sync.Mutex
+	cached int
+	frame  []byte
+}
+
+func newSeekableReader(r io.ReaderAt, storedSize int64) (*seekableReader, error) {
+	if storedSize < 8+seekTableFooterSize {
+		return nil, fmt.Errorf("too small to be a seekable stream")
+	}
+	footer := make([]byte, seekTableFooterSize)
+	if _, err := r.ReadAt(footer, storedSize-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, fmt.Errorf("missing seekable zstd footer")
+	}
+	if footer[4] != 0 {
+		return nil, fmt.Errorf("unsupported seek table descriptor %x", footer[4])
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[0:]))
+	tableStart := storedSize - seekTableFooterSize - 8*frames - 8
+	if tableStart < 0 {
+		return nil, fmt.Errorf("seek table larger than stream")
+	}
+	table := make([]byte, 8*frames+8)
+	if _, err := r.ReadAt(table, tableStart); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:]) != skippableFrameMagic {
+		return nil, fmt.Errorf("malformed seek table")
+	}
+
+	s := &seekableReader{r: r, offsets: make([]int64, frames+1), starts: make([]int64, frames+1), cached: -1}
+	for i := int64(0); i < frames; i++ {
+		s.offsets[i+1] = s.offsets[i] + int64(binary.LittleEndian.Uint32(table[8+8*i:]))
+		s.starts[i+1] = s.starts[i] + int64(binary.LittleEndian.Uint32(table[12+8*i:]))
+	}
+	if s.offsets[frames] != tableStart {
+		return nil, fmt.Errorf("seek table does not match stream size")
+	}
+	return s, nil
+}
+
+// Size is the decompressed size of the stream.
+func (s *seekableReader) Size() int64 {
+	return s.starts[len(s.starts)-1]
+}
+
+func (s *seekableReader) ReadAt(p []byte, off int64) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		if off >= s.Size() {
+			return n, io.EOF
+		}
+		i := sort.Search(len(s.starts), func(i int) bool { return s.starts[i] > off }) - 1
+		if err := s.load(i); err != nil {
+			return n, err
+		}
+		c := copy(p, s.frame[off-s.starts[i]:])
+		p = p[c:]
+		off += int64(c)
+		n += c
+	}
+	return n, nil
+}
+
+// load decompresses frame i into the cache. The caller must hold the lock.
+func (s *seekableReader) load(i int) error {
+	if s.cached == i {
+		return nil
+	}
+	compressed := make([]byte, s.offsets[i+1]-s.offsets[i])
+	if _, err := s.r.ReadAt(compressed, s.offsets[i]); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	frame, err := zstd.Decompress(make([]byte, s.starts[i+1]-s.starts[i]), compressed)
+	if err != nil {
+		return fmt.Errorf("decompressing frame %d: %w", i, err)
+	}
+	s.cached = i
+	s.frame = frame
+	return nil
+}
+
+var statsCmd = &cli.Command{
+	Name:  "stats",
+	Usage: "show the stored size and compression ratio of each sector",
+	Action: func(cctx *cli.Context) error {
+		store, err := openStore(cctx)
+		if err != nil {
+			return err
+		}
+		i := store.snapshot()
+		sectors := make([]uint64, 0, len(i.Metadata))
+		for n := range i.Metadata {
+			sectors = append(sectors, n)
+		}
+		sort.Slice(sectors, func(a, b int) bool { return sectors[a] < sectors[b] })
+
+		var total, stored int64
+		fmt.Printf("sector\tsize\tstored\tratio\tencoding\n")
+		for _, n := range sectors {
+			sm, err := store.readSidecar(n)
+			if err != nil {
+				fmt.Printf("%d\t-\t-\t-\tno sidecar\n", n)
+				continue
+			}
+			total += sm.Size
+			stored += sm.StoredSize()
+			encoding := sm.Encoding
+			if encoding == "" {
+				encoding = "raw"
+			}
+			if sm.Encryption != nil {
+				encoding += "+" + sm.Encryption.Cipher
+			}
+			fmt.Printf("%d\t%d\t%d\t%.2f\t%s\n", n, sm.Size, sm.StoredSize(), ratio(sm.Size, sm.StoredSize()), encoding)
+		}
+		fmt.Printf("total\t%d\t%d\t%.2f\n", total, stored, ratio(total, stored))
+		return nil
+	},
+}
+
+func ratio(size, stored int64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(size) / float64(stored)
+}
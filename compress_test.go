@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestSeekableRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 1000},
+		{"one frame", seekableFrameSize},
+		{"frame and a byte", seekableFrameSize + 1},
+		{"several frames", 2*seekableFrameSize + seekableFrameSize/2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([]byte, tc.size)
+			rng := rand.New(rand.NewSource(int64(tc.size)))
+			// half random and half zeros, so frames compress unevenly.
+			rng.Read(data[:tc.size/2])
+
+			var stored bytes.Buffer
+			w := newSeekableWriter(&stored)
+			if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := newSeekableReader(bytes.NewReader(stored.Bytes()), int64(stored.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(tc.size) {
+				t.Fatalf("size %d, want %d", r.Size(), tc.size)
+			}
+			got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read back %d bytes, want %d: %v", len(got), len(data), err)
+			}
+
+			for i := 0; i < 20 && tc.size > 0; i++ {
+				off := rng.Intn(tc.size)
+				n := rng.Intn(tc.size-off) + 1
+				p := make([]byte, n)
+				if _, err := r.ReadAt(p, int64(off)); err != nil && err != io.EOF {
+					t.Fatalf("ReadAt(%d, %d): %v", n, off, err)
+				}
+				if !bytes.Equal(p, data[off:off+n]) {
+					t.Fatalf("ReadAt(%d, %d) returned the wrong data", n, off)
+				}
+			}
+		})
+	}
+}
+
+func TestSeekableReaderRejectsBadStreams(t *testing.T) {
+	var stored bytes.Buffer
+	w := newSeekableWriter(&stored)
+	w.Write(bytes.Repeat([]byte("piece"), 1000))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := stored.Bytes()
+
+	for _, tc := range []struct {
+		name   string
+		stored []byte
+	}{
+		{"truncated", b[:len(b)-4]},
+		{"too short", b[:8]},
+		{"not seekable", bytes.Repeat([]byte{7}, 100)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newSeekableReader(bytes.NewReader(tc.stored), int64(len(tc.stored))); err == nil {
+				t.Fatal("accepted a malformed stream")
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Encrypted pieces are split into fixed size chunks, each sealed with
+// AES-256-GCM under a random per-sector data key, so a range can be read by
+// opening only the chunks it overlaps. The chunk index is the nonce, and the
+// last chunk is marked in its additional data so truncation is detected.
+// Data keys are stored in the sidecar, wrapped by the master key.
+const (
+	cipherChunkedAESGCM = "aes-256-gcm-chunked"
+
+	cryptChunkSize = 64 << 10
+	cryptOverhead  = 16
+
+	masterKeyEnv = "DUMBFILSTORE_MASTER_KEY"
+)
+
+// sectorKey is a sector's data key, wrapped by the master key identified by KeyID.
+type sectorKey struct {
+	Cipher  string
+	KeyID   string
+	Wrapped []byte
+}
+
+// Errors opening an encrypted sector because of the master key configuration,
+// rather than its data.
+var (
+	errNoMasterKey    = errors.New("no master key is loaded")
+	errWrongMasterKey = errors.New("wrong master key")
+)
+
+func isKeyError(err error) bool {
+	return errors.Is(err, errNoMasterKey) || errors.Is(err, errWrongMasterKey)
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newMasterKey(raw []byte) (*masterKey, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(raw))
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(raw)
+	return &masterKey{hex.EncodeToString(id[:8]), aead}, nil
+}
+
+// loadMasterKey reads a hex encoded master key from path, or from the
+// environment if path is empty. It returns nil if neither is set.
+func loadMasterKey(path string) (*masterKey, error) {
+	encoded := os.Getenv(masterKeyEnv)
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not hex encoded: %w", err)
+	}
+	return newMasterKey(raw)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (m *masterKey) wrap(dataKey []byte) (*sectorKey, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &sectorKey{cipherChunkedAESGCM, m.id, m.aead.Seal(nonce, nonce, dataKey, nil)}, nil
+}
+
+func (m *masterKey) unwrap(sk *sectorKey) ([]byte, error) {
+	if sk.KeyID != m.id {
+		return nil, fmt.Errorf("%w: data key is wrapped by master key %s, not %s", errWrongMasterKey, sk.KeyID, m.id)
+	}
+	ns := m.aead.NonceSize()
+	if len(sk.Wrapped) < ns {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+	return m.aead.Open(nil, sk.Wrapped[:ns], sk.Wrapped[ns:], nil)
+}
+
+func chunkNonce(aead cipher.AEAD, i uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], i)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingWriter seals everything written to it with a fresh data key.
+// Close must be called to seal the final chunk; it does not close w.
+type encryptingWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+}
+
+func newEncryptingWriter(w io.Writer, m *masterKey) (*encryptingWriter, *sectorKey, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	sk, err := m.wrap(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &encryptingWriter{w: w, aead: aead, buf: make([]byte, 0, cryptChunkSize)}, sk, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// a full buffer is only sealed once more data arrives, since the last chunk is sealed differently.
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		c := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) seal(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.chunk), e.buf, chunkAD(final))
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.chunk++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptingReader gives random access to the plaintext of an encrypted stream.
+type decryptingReader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	chunks int64
+	size   int64
+
+	l      sync.Mutex
+	cached int64
+	plain  []byte
+}
+
+func newDecryptingReader(r io.ReaderAt, storedSize int64, dataKey []byte) (*decryptingReader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	chunks := (storedSize + cryptChunkSize + cryptOverhead - 1) / (cryptChunkSize + cryptOverhead)
+	if chunks == 0 {
+		return nil, fmt.Errorf("encrypted stream is empty")
+	}
+	return &decryptingReader{r: r, aead: aead, chunks: chunks, size: storedSize - chunks*cryptOverhead, cached: -1}, nil
+}
+
+// Size is the plaintext size of the stream.
+func (d *decryptingReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptingReader) ReadAt(p []byte, off int64) (int, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return n, io.EOF
+		}
+		i := off / cryptChunkSize
+		if err := d.load(i); err != nil {
+			return n, err
+		}
+		c := copy(p, d.plain[off-i*cryptChunkSize:])
+		p = p[c:]
+		off += int64(c)
+		n += c
+	}
+	return n, nil
+}
+
+// load opens chunk i into the cache. The caller must hold the lock.
+func (d *decryptingReader) load(i int64) error {
+	if d.cached == i {
+		return nil
+	}
+	sealed := make([]byte, cryptChunkSize+cryptOverhead)
+	n, err := d.r.ReadAt(sealed, i*(cryptChunkSize+cryptOverhead))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.aead, uint64(i)), sealed[:n], chunkAD(i == d.chunks-1))
+	if err != nil {
+		d.cached = -1
+		return fmt.Errorf("decrypting chunk %d: %w", i, err)
+	}
+	d.cached = i
+	d.plain = plain
+	return nil
+}
+
+var rotateKeyCmd = &cli.Command{
+	Name:  "rotate-key",
+	Usage: "rewrap sector data keys under a new master key, without rewriting piece data",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "new-key-file",
+			Usage:    "file holding the new hex encoded master key",
+			Required: true,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		store, err := openStore(cctx)
+		if err != nil {
+			return err
+		}
+		if store.key == nil {
+			return fmt.Errorf("the current master key must be provided with --master-key-file or %s", masterKeyEnv)
+		}
+		next, err := loadMasterKey(cctx.String("new-key-file"))
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return fmt.Errorf("--new-key-file is empty")
+		}
+
+		n, err := store.RotateKey(next)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rewrapped %d sector keys under master key %s\n", n, next.id)
+		return nil
+	},
+}
+
+// RotateKey rewraps the data key of every encrypted sector, including
+// quarantined ones, under next. Sectors already using next are skipped, so an
+// interrupted rotation can be rerun.
+func (f *filestore) RotateKey(next *masterKey) (int, error) {
+	if f.key != nil && next.id == f.key.id {
+		return 0, fmt.Errorf("the new master key is the current one, %s", next.id)
+	}
+	rotated := 0
+	for _, dir := range []string{f.root, path.Join(f.root, "quarantine")} {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return rotated, err
+		}
+		for _, e := range entries {
+			var n uint64
+			if _, err := fmt.Sscanf(e.Name(), "%d.meta", &n); err != nil || e.Name() != fmt.Sprintf("%d.meta", n) {
+				continue
+			}
+			p := path.Join(dir, e.Name())
+			sm, err := readSidecarFile(p)
+			if err != nil {
+				return rotated, err
+			}
+			if sm.Encryption == nil || sm.Encryption.KeyID == next.id {
+				continue
+			}
+			dataKey, err := f.key.unwrap(sm.Encryption)
+			if err != nil {
+				return rotated, fmt.Errorf("sector %d: %w", n, err)
+			}
+			if sm.Encryption, err = next.wrap(dataKey); err != nil {
+				return rotated, err
+			}
+			if err := writeSidecarFile(p, sm); err != nil {
+				return rotated, err
+			}
+			rotated++
+		}
+	}
+	return rotated, nil
+}
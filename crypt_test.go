@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	m, err := newMasterKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"one chunk", cryptChunkSize},
+		{"chunk and a byte", cryptChunkSize + 1},
+		{"several chunks", 3*cryptChunkSize + 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, stored, dataKey := encryptForTest(t, m, tc.size)
+			r, err := newDecryptingReader(bytes.NewReader(stored), int64(len(stored)), dataKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(tc.size) {
+				t.Fatalf("size %d, want %d", r.Size(), tc.size)
+			}
+			got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read back %d bytes, want %d: %v", len(got), len(data), err)
+			}
+			if tc.size > 10 {
+				p := make([]byte, 10)
+				off := int64(tc.size - 10)
+				if _, err := r.ReadAt(p, off); err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(p, data[off:]) {
+					t.Fatal("ranged read returned the wrong data")
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	m, err := newMasterKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := cryptChunkSize + cryptOverhead
+
+	for _, tc := range []struct {
+		name   string
+		tamper func(stored []byte) []byte
+		// the chunks that must still read back correctly.
+		intact []int64
+	}{
+		{
+			name: "flipped byte",
+			tamper: func(stored []byte) []byte {
+				stored[sealed+7] ^= 1
+				return stored
+			},
+			intact: []int64{0, 2},
+		},
+		{
+			name: "swapped chunks",
+			tamper: func(stored []byte) []byte {
+				first := append([]byte(nil), stored[:sealed]...)
+				copy(stored, stored[sealed:2*sealed])
+				copy(stored[sealed:], first)
+				return stored
+			},
+			intact: []int64{2},
+		},
+		{
+			name: "truncated to whole chunks",
+			tamper: func(stored []byte) []byte {
+				return stored[:2*sealed]
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, stored, dataKey := encryptForTest(t, m, 2*cryptChunkSize+100)
+			stored = tc.tamper(stored)
+			r, err := newDecryptingReader(bytes.NewReader(stored), int64(len(stored)), dataKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size())); err == nil {
+				t.Fatal("read tampered data without error")
+			}
+			for _, i := range tc.intact {
+				p := make([]byte, 10)
+				if _, err := r.ReadAt(p, i*cryptChunkSize); err != nil {
+					t.Fatalf("chunk %d: %v", i, err)
+				}
+				if !bytes.Equal(p, data[i*cryptChunkSize:i*cryptChunkSize+10]) {
+					t.Fatalf("chunk %d returned the wrong data", i)
+				}
+			}
+		})
+	}
+}
+
+func TestMasterKeyUnwrap(t *testing.T) {
+	m, _ := newMasterKey(bytes.Repeat([]byte{1}, 32))
+	other, _ := newMasterKey(bytes.Repeat([]byte{2}, 32))
+	sk, err := m.wrap(bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *sk
+	forged.KeyID = other.id
+
+	for _, tc := range []struct {
+		name    string
+		key     *masterKey
+		wrapped *sectorKey
+		ok      bool
+	}{
+		{"same key", m, sk, true},
+		{"other key", other, sk, false},
+		{"other key under the right id", other, &forged, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := tc.key.unwrap(tc.wrapped)
+			if tc.ok != (err == nil) {
+				t.Fatalf("unwrap: %v, want success %v", err, tc.ok)
+			}
+			if tc.ok && !bytes.Equal(k, bytes.Repeat([]byte{3}, 32)) {
+				t.Fatal("unwrapped the wrong key")
+			}
+		})
+	}
+}
+
+// encryptForTest seals size bytes of random data under a fresh data key wrapped by m.
+func encryptForTest(t *testing.T, m *masterKey, size int) (data, stored, dataKey []byte) {
+	t.Helper()
+	data = make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	var b bytes.Buffer
+	w, sk, err := newEncryptingWriter(&b, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if dataKey, err = m.unwrap(sk); err != nil {
+		t.Fatal(err)
+	}
+	return data, b.Bytes(), dataKey
+}
+
+func TestRotateKey(t *testing.T) {
+	key, next := testMasterKey(t, 1), testMasterKey(t, 2)
+	f, sectors := newFilledStore(t, key, 1, 2)
+
+	if _, err := f.RotateKey(key); err == nil {
+		t.Fatal("rotated to the current key")
+	}
+	n, err := f.RotateKey(next)
+	if err != nil || n != len(sectors) {
+		t.Fatalf("rotated %d sectors, want %d: %v", n, len(sectors), err)
+	}
+	// rerunning an interrupted rotation skips sectors already rotated.
+	f.key = key
+	if n, err := f.RotateKey(next); err != nil || n != 0 {
+		t.Fatalf("rerun rotated %d sectors: %v", n, err)
+	}
+
+	f.key = next
+	for i, n := range sectors {
+		data, _ := testPiece(t, int64(i+1))
+		r, err := f.openSector(context.Background(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(data))
+		_, err = r.ReadAt(got, 0)
+		r.Close()
+		if err != nil && err != io.EOF || !bytes.Equal(got, data) {
+			t.Fatalf("sector %d doesn't read back under the new key: %v", n, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,25 +9,49 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/storage/sealer/fr32"
 	"github.com/filecoin-project/lotus/storage/sealer/tarutil"
 	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type filestore struct {
 	root string
 	i    index
 	l    sync.RWMutex
+
+	// sectors allocated but still being written.
+	pending map[uint64]struct{}
+	// set once the store is shutting down, so it takes no new pieces.
+	closing bool
+	// the number of sector reads in progress.
+	downloads int64
+	// whether new pieces are stored compressed and encrypted.
+	compress bool
+	encrypt  bool
+	// wraps sector data keys, if set.
+	key *masterKey
 }
 
 // the serialized structure inside of the index file.
 type index struct {
-	N        uint64
-	Metadata map[uint64]api.PieceDealInfo
+	N          uint64
+	Metadata   map[uint64]api.PieceDealInfo
+	Quarantine map[uint64]quarantined `json:",omitempty"`
+}
+
+// quarantined sectors have failed an integrity check and are no longer served.
+type quarantined struct {
+	Reason   string
+	DealInfo api.PieceDealInfo
 }
 
 func NewStore(root string) (*filestore, error) {
@@ -39,57 +64,289 @@ func NewStore(root string) (*filestore, error) {
 		return nil, err
 	}
 
-	i := index{0, make(map[uint64]api.PieceDealInfo)}
+	f := &filestore{
+		root:    root,
+		i:       index{N: 0, Metadata: make(map[uint64]api.PieceDealInfo)},
+		pending: make(map[uint64]struct{}),
+	}
 	if _, err := os.Stat(path.Join(root, "index")); err == nil {
 		idx, err := os.ReadFile(path.Join(root, "index"))
 		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(idx, &i); err != nil {
+		if err := json.Unmarshal(idx, &f.i); err != nil {
 			return nil, err
 		}
 	} else {
-		b, _ := json.Marshal(i)
-		if err := os.WriteFile(path.Join(root, "index"), b, 0660); err != nil {
+		// the index is a cache over the sector sidecars, so rebuild it from any that exist.
+		if err := f.loadSidecars(); err != nil {
 			return nil, err
 		}
+		if err := f.saveIndex(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.i.Quarantine == nil {
+		f.i.Quarantine = make(map[uint64]quarantined)
 	}
 
-	return &filestore{root, i, sync.RWMutex{}}, nil
+	return f, nil
 }
 
-func (f *filestore) saveIndex() error {
-	fi, err := os.OpenFile(path.Join(f.root, "index"), os.O_TRUNC|os.O_WRONLY, 0660)
-	if err != nil {
+// saveIndex persists the index. The caller must hold the write lock.
+// The index is written to a temporary file and renamed into place so that
+// readers of the store root (e.g. a concurrent backup) never see a partial index.
+func (f *filestore) saveIndex(ctx context.Context) error {
+	start := time.Now()
+	defer prometheus.NewTimer(indexSaveDuration.WithLabelValues(f.root)).ObserveDuration()
+	tmp := path.Join(f.root, "index.tmp")
+	b, _ := json.Marshal(f.i)
+	if err := os.WriteFile(tmp, b, 0660); err != nil {
 		return err
 	}
-	defer fi.Close()
-	b, _ := json.Marshal(f.i)
-	if _, err := fi.Write(b); err != nil {
+	if err := os.Rename(tmp, path.Join(f.root, "index")); err != nil {
 		return err
 	}
+	requestLogger(ctx, storeLog).Debugw("saved index", "root", f.root, "sectors", len(f.i.Metadata), "duration", time.Since(start))
 	return nil
 }
 
-func (f *filestore) Add(r io.Reader, md api.PieceDealInfo) (uint64, error) {
+func (f *filestore) sectorPath(n uint64) string {
+	return path.Join(f.root, fmt.Sprintf("%d.sector", n))
+}
+
+// sectorReader gives random access to the unpadded piece data of a sector, however it is stored.
+type sectorReader interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+type rawSector struct {
+	*os.File
+	size int64
+}
+
+func (r *rawSector) Size() int64 {
+	return r.size
+}
+
+type encodedSector struct {
+	io.ReaderAt
+	io.Closer
+	size int64
+}
+
+func (e *encodedSector) Size() int64 {
+	return e.size
+}
+
+// openSector opens the piece data of sector n, decrypting and decompressing it
+// as described by its sidecar. Compression is detected if the sector has none.
+func (f *filestore) openSector(ctx context.Context, n uint64) (sectorReader, error) {
+	fi, err := os.Open(f.sectorPath(n))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fi.Stat()
+	if err != nil {
+		fi.Close()
+		return nil, err
+	}
+
+	sm, err := f.readSidecar(n)
+	if err != nil {
+		if sr, err := newSeekableReader(fi, stat.Size()); err == nil {
+			return &encodedSector{sr, fi, sr.Size()}, nil
+		}
+		return &rawSector{fi, stat.Size()}, nil
+	}
+
+	requestLogger(ctx, storeLog).Debugw("opening sector", "root", f.root, "sector", n, "encoding", sm.Encoding, "encrypted", sm.Encryption != nil)
+	var r io.ReaderAt = fi
+	size := stat.Size()
+	if sm.Encryption != nil {
+		if f.key == nil {
+			fi.Close()
+			return nil, fmt.Errorf("sector %d is encrypted: %w", n, errNoMasterKey)
+		}
+		dataKey, err := f.key.unwrap(sm.Encryption)
+		if err != nil {
+			fi.Close()
+			return nil, fmt.Errorf("sector %d: %w", n, err)
+		}
+		dr, err := newDecryptingReader(fi, size, dataKey)
+		if err != nil {
+			fi.Close()
+			return nil, err
+		}
+		r, size = dr, dr.Size()
+	}
+
+	switch sm.Encoding {
+	case "":
+	case encodingZstdSeekable:
+		sr, err := newSeekableReader(r, size)
+		if err != nil {
+			fi.Close()
+			return nil, err
+		}
+		r, size = sr, sr.Size()
+	default:
+		fi.Close()
+		return nil, fmt.Errorf("sector %d has unknown encoding %q", n, sm.Encoding)
+	}
+
+	if r == io.ReaderAt(fi) {
+		return &rawSector{fi, size}, nil
+	}
+	return &encodedSector{r, fi, size}, nil
+}
+
+// Add stores a piece as a new sector. The sector number is reserved up front,
+// but metadata is only recorded once the data and its sidecar are fully written,
+// so any sector with metadata in the index is complete on disk.
+func (f *filestore) Add(ctx context.Context, r io.Reader, md api.PieceDealInfo) (uint64, error) {
+	log := requestLogger(ctx, storeLog).With("root", f.root)
 	f.l.Lock()
+	if f.closing {
+		f.l.Unlock()
+		return 0, errClosing
+	}
 	alloc := atomic.AddUint64(&f.i.N, 1) - 1
-	f.i.Metadata[alloc] = md
-	f.saveIndex()
+	f.pending[alloc] = struct{}{}
+	err := f.saveIndex(ctx)
 	f.l.Unlock()
+	defer func() {
+		f.l.Lock()
+		delete(f.pending, alloc)
+		f.l.Unlock()
+	}()
+	if err != nil {
+		return 0, err
+	}
 
-	fi, err := os.OpenFile(path.Join(f.root, fmt.Sprintf("%d.sector", alloc)), os.O_CREATE|os.O_WRONLY, 0660)
+	start := time.Now()
+	sm, err := f.writeSector(alloc, &countingReader{r, ingestBytes.WithLabelValues(f.root)}, md)
 	if err != nil {
+		log.Warnw("writing piece failed", "sector", alloc, "error", err)
 		return 0, err
 	}
-	defer fi.Close()
-	if _, err := io.Copy(fi, r); err != nil {
+	if err := f.writeSidecar(alloc, sm); err != nil {
+		log.Warnw("writing sidecar failed", "sector", alloc, "error", err)
 		return 0, err
 	}
 
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.i.Metadata[alloc] = md
+	if err := f.saveIndex(ctx); err != nil {
+		return 0, err
+	}
+	ingestDuration.WithLabelValues(f.root).Observe(time.Since(start).Seconds())
+	log.Infow("stored piece", "sector", alloc, "deal", md.DealID, "size", sm.Size, "duration", time.Since(start))
 	return alloc, nil
 }
 
+var errClosing = errors.New("the store is shutting down")
+
+// close stops the store taking new pieces.
+func (f *filestore) close() {
+	f.l.Lock()
+	f.closing = true
+	f.l.Unlock()
+}
+
+// drain waits until no sectors are being written or read, or ctx is done. It
+// returns the sectors still being written and the number of reads in progress.
+func (f *filestore) drain(ctx context.Context) ([]uint64, int64) {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		f.l.RLock()
+		writing := make([]uint64, 0, len(f.pending))
+		for n := range f.pending {
+			writing = append(writing, n)
+		}
+		f.l.RUnlock()
+		reading := atomic.LoadInt64(&f.downloads)
+
+		if len(writing) == 0 && reading == 0 || ctx.Err() != nil {
+			sort.Slice(writing, func(i, j int) bool { return writing[i] < writing[j] })
+			return writing, reading
+		}
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+	}
+}
+
+// flush writes out the index.
+func (f *filestore) flush(ctx context.Context) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.saveIndex(ctx)
+}
+
+// snapshot returns a copy of the index that is safe to use without holding the lock.
+func (f *filestore) snapshot() index {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.copyIndex()
+}
+
+// copyIndex copies the index. The caller must hold the lock.
+func (f *filestore) copyIndex() index {
+	i := index{
+		N:          f.i.N,
+		Metadata:   make(map[uint64]api.PieceDealInfo, len(f.i.Metadata)),
+		Quarantine: make(map[uint64]quarantined, len(f.i.Quarantine)),
+	}
+	for n, md := range f.i.Metadata {
+		i.Metadata[n] = md
+	}
+	for n, q := range f.i.Quarantine {
+		i.Quarantine[n] = q
+	}
+	return i
+}
+
+// Quarantine stops a sector from being served, moving its data aside for inspection.
+func (f *filestore) Quarantine(ctx context.Context, n uint64, reason string) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	md, ok := f.i.Metadata[n]
+	if !ok {
+		return fmt.Errorf("sector %d not found", n)
+	}
+	if err := f.moveToQuarantine(n); err != nil {
+		return err
+	}
+	delete(f.i.Metadata, n)
+	f.i.Quarantine[n] = quarantined{reason, md}
+	requestLogger(ctx, storeLog).Warnw("quarantined sector", "root", f.root, "sector", n, "reason", reason)
+	return f.saveIndex(ctx)
+}
+
+// moveToQuarantine moves the files of sector n, if any, into quarantine/.
+// The caller must hold the write lock.
+func (f *filestore) moveToQuarantine(n uint64) error {
+	qdir := path.Join(f.root, "quarantine")
+	if err := os.MkdirAll(qdir, 0770); err != nil {
+		return err
+	}
+	if err := os.Rename(f.sectorPath(n), path.Join(qdir, fmt.Sprintf("%d.sector", n))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(f.metaPath(n), path.Join(qdir, fmt.Sprintf("%d.meta", n))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
 func (f *filestore) GetMeta(n uint64) *api.PieceDealInfo {
 	pdi, ok := f.i.Metadata[n]
 	if !ok {
@@ -98,11 +355,35 @@ func (f *filestore) GetMeta(n uint64) *api.PieceDealInfo {
 	return &pdi
 }
 
-func (f *filestore) retrieveHandler() http.Handler {
+// findPiece returns the sector holding the piece given by a sector number or piece CID.
+func (f *filestore) findPiece(s string) (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if _, ok := f.i.Metadata[n]; !ok {
+			return 0, fmt.Errorf("sector %d not found", n)
+		}
+		return n, nil
+	}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a sector number nor a piece CID", s)
+	}
+	for n, md := range f.i.Metadata {
+		if md.DealProposal != nil && md.DealProposal.PieceCID == c {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("piece %s not found", c)
+}
+
+// retrieveHandler serves sector data under base.
+func (f *filestore) retrieveHandler(base string) http.Handler {
 	mux := mux.NewRouter()
+	sub := mux.PathPrefix(base).Subrouter()
 
-	mux.HandleFunc("/{type}/{id}/{spt}/allocated/{offset}/{size}", f.hasAllocated).Methods("GET")
-	mux.HandleFunc("/{type}/{id}", f.get).Methods("GET")
+	sub.HandleFunc("/{id}/{spt}/allocated/{offset}/{size}", f.hasAllocated).Methods("GET")
+	sub.HandleFunc("/{id}", f.get).Methods("GET")
 	return mux
 }
 
@@ -131,6 +412,11 @@ func (f *filestore) hasAllocated(w http.ResponseWriter, r *http.Request) {
 var CopyBuf = 1 << 20
 
 func (f *filestore) get(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&f.downloads, 1)
+	defer atomic.AddInt64(&f.downloads, -1)
+	_, ranged := r.Header["Range"]
+	retrievalRequests.WithLabelValues(f.root, strconv.FormatBool(ranged)).Inc()
+	w = &countingResponseWriter{w, retrievalBytes.WithLabelValues(f.root)}
 	vars := mux.Vars(r)
 
 	id_str := vars["id"]
@@ -145,7 +431,7 @@ func (f *filestore) get(w http.ResponseWriter, r *http.Request) {
 	f.l.RUnlock()
 
 	if ok {
-		p := path.Join(f.root, fmt.Sprintf("%d.sector", id))
+		p := f.sectorPath(id)
 
 		stat, err := os.Stat(p)
 		if err != nil {
@@ -155,7 +441,7 @@ func (f *filestore) get(w http.ResponseWriter, r *http.Request) {
 
 		if stat.IsDir() {
 			if _, has := r.Header["Range"]; has {
-				fmt.Println("Range not supported on directories")
+				requestLogger(r.Context(), storeLog).Warnw("range not supported on directories", "sector", id)
 				w.WriteHeader(500)
 				return
 			}
@@ -165,23 +451,23 @@ func (f *filestore) get(w http.ResponseWriter, r *http.Request) {
 
 			err := tarutil.TarDirectory(p, w, make([]byte, CopyBuf))
 			if err != nil {
-				fmt.Printf("send tar: %+v\n", err)
+				requestLogger(r.Context(), storeLog).Warnw("sending tar failed", "sector", id, "error", err)
 				return
 			}
 		} else {
 			w.Header().Set("Content-Type", "application/octet-stream")
 			// will do a ranged read over the file at the given path if the caller has asked for a ranged read in the request headers.
 
-			f, err := os.Open(p)
+			sr, err := f.openSector(r.Context(), id)
 			if err != nil {
 				w.WriteHeader(500)
 				return
 			}
-			defer f.Close()
+			defer sr.Close()
 
 			paddedSize := md.DealProposal.PieceSize
 
-			ssr := paddedReaderAt{f, [128]byte{}, 0, int64(paddedSize)}
+			ssr := paddedReaderAt{sr, [128]byte{}, 0, int64(paddedSize)}
 
 			http.ServeContent(w, r, p, stat.ModTime(), &ssr)
 		}
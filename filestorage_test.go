@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+)
+
+// testPiece returns piece data derived from seed, and a deal for it.
+func testPiece(t *testing.T, seed int64) ([]byte, api.PieceDealInfo) {
+	t.Helper()
+	data := make([]byte, 127*8)
+	rand.New(rand.NewSource(seed)).Read(data)
+	size := abi.UnpaddedPieceSize(len(data)).Padded()
+	c, err := pieceCID(bytes.NewReader(data), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, api.PieceDealInfo{
+		DealID:       abi.DealID(seed),
+		DealProposal: &market.DealProposal{PieceCID: c, PieceSize: size},
+	}
+}
+
+// addTestPieces stores a piece for each seed in f, returning their sectors.
+func addTestPieces(t *testing.T, f *filestore, seeds ...int64) []uint64 {
+	t.Helper()
+	var sectors []uint64
+	for _, seed := range seeds {
+		data, md := testPiece(t, seed)
+		n, err := f.Add(context.Background(), bytes.NewReader(data), md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sectors = append(sectors, n)
+	}
+	return sectors
+}
+
+func newTestStore(t *testing.T) *filestore {
+	t.Helper()
+	f, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// newFilledStore returns a new store holding a piece for each seed, encrypted
+// under key unless it is nil, and their sectors.
+func newFilledStore(t *testing.T, key *masterKey, seeds ...int64) (*filestore, []uint64) {
+	t.Helper()
+	f := newTestStore(t)
+	if key != nil {
+		f.encrypt, f.key = true, key
+	}
+	return f, addTestPieces(t, f, seeds...)
+}
+
+// testMasterKey returns a master key of b repeated.
+func testMasterKey(t *testing.T, b byte) *masterKey {
+	t.Helper()
+	m, err := newMasterKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// assertSectors fails unless got holds the sectors in want, in any order.
+func assertSectors(t *testing.T, what string, got, want []uint64) {
+	t.Helper()
+	set := make(map[uint64]bool)
+	for _, n := range got {
+		set[n] = true
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s sectors %v, want %v", what, got, want)
+		return
+	}
+	for _, n := range want {
+		if !set[n] {
+			t.Errorf("%s sectors %v, want %v", what, got, want)
+			return
+		}
+	}
+}
+
+func keys(m map[uint64]string) []uint64 {
+	var ks []uint64
+	for n := range m {
+		ks = append(ks, n)
+	}
+	return ks
+}
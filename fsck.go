@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// fsckReport is the outcome of checking the store against its index.
+type fsckReport struct {
+	Checked int
+	// Bad sectors have metadata, but their data is missing or does not match it.
+	Bad map[uint64]string
+	// Orphans are sector files with no metadata, left by interrupted uploads.
+	Orphans []uint64
+	// Unchecked sectors could not be opened because of the master key
+	// configuration, so nothing is known about their data.
+	Unchecked map[uint64]string
+}
+
+// orphanAge is how long a sector file with no metadata must go unmodified
+// before it is reported as orphaned. Until then it may be an upload in progress
+// in another process, such as the instance serving the store, which also
+// reserves sectors beyond the index this one loaded.
+const orphanAge = 10 * time.Minute
+
+var fsckCmd = &cli.Command{
+	Name:  "fsck",
+	Usage: "verify piece data in the store against the index",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "quarantine",
+			Usage: "stop serving sectors that fail verification. The store must not be in use by a running instance",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-commp",
+			Usage: "only check that data exists with the expected size",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		store, err := openStore(cctx)
+		if err != nil {
+			return err
+		}
+		if cctx.Bool("quarantine") {
+			if err := store.checkKey(); err != nil {
+				return err
+			}
+		}
+		rep, err := store.Check(cctx.Context, !cctx.Bool("skip-commp"))
+		if err != nil {
+			return err
+		}
+
+		bad := make([]uint64, 0, len(rep.Bad))
+		for n := range rep.Bad {
+			bad = append(bad, n)
+		}
+		sort.Slice(bad, func(i, j int) bool { return bad[i] < bad[j] })
+		for _, n := range bad {
+			fmt.Printf("sector %d: %s\n", n, rep.Bad[n])
+			if cctx.Bool("quarantine") {
+				if err := store.Quarantine(cctx.Context, n, rep.Bad[n]); err != nil {
+					return err
+				}
+			}
+		}
+		for _, n := range rep.Orphans {
+			fmt.Printf("sector %d: orphaned data with no metadata\n", n)
+		}
+		for n, reason := range rep.Unchecked {
+			fmt.Printf("sector %d: not checked: %s\n", n, reason)
+		}
+		fmt.Printf("checked %d sectors: %d bad, %d orphaned, %d not checked\n", rep.Checked, len(rep.Bad), len(rep.Orphans), len(rep.Unchecked))
+
+		if len(rep.Bad) > 0 || len(rep.Orphans) > 0 || len(rep.Unchecked) > 0 {
+			return cli.Exit("", 1)
+		}
+		return nil
+	},
+}
+
+// Check verifies each sector in the index has data of the expected size,
+// optionally recomputing its CommP, and looks for sector files with no metadata.
+func (f *filestore) Check(ctx context.Context, verifyCommP bool) (*fsckReport, error) {
+	i := f.snapshot()
+	rep := &fsckReport{Bad: make(map[uint64]string), Unchecked: make(map[uint64]string)}
+
+	for n, md := range i.Metadata {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		rep.Checked++
+
+		if _, err := os.Stat(f.sectorPath(n)); err != nil {
+			rep.Bad[n] = fmt.Sprintf("missing data: %s", err)
+			continue
+		}
+		sr, err := f.openSector(ctx, n)
+		if isKeyError(err) {
+			rep.Unchecked[n] = err.Error()
+			continue
+		} else if err != nil {
+			rep.Bad[n] = fmt.Sprintf("unreadable: %s", err)
+			continue
+		}
+		expected := int64(md.DealProposal.PieceSize.Unpadded())
+		if sr.Size() != expected {
+			rep.Bad[n] = fmt.Sprintf("size %d, expected %d", sr.Size(), expected)
+			sr.Close()
+			continue
+		}
+		if !verifyCommP {
+			sr.Close()
+			continue
+		}
+
+		h := sha256.New()
+		c, err := pieceCID(io.TeeReader(io.NewSectionReader(sr, 0, sr.Size()), h), md.DealProposal.PieceSize)
+		sr.Close()
+		if err != nil {
+			rep.Bad[n] = fmt.Sprintf("computing commp: %s", err)
+		} else if !c.Equals(md.DealProposal.PieceCID) {
+			rep.Bad[n] = fmt.Sprintf("commp %s, expected %s", c, md.DealProposal.PieceCID)
+		} else if sm, err := f.readSidecar(n); err == nil && sm.SHA256 != hex.EncodeToString(h.Sum(nil)) {
+			rep.Bad[n] = "sha256 does not match sidecar"
+		}
+	}
+
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+	f.l.RLock()
+	defer f.l.RUnlock()
+	for _, e := range entries {
+		var n uint64
+		if _, err := fmt.Sscanf(e.Name(), "%d.sector", &n); err != nil || e.Name() != fmt.Sprintf("%d.sector", n) {
+			continue
+		}
+		_, known := f.i.Metadata[n]
+		_, writing := f.pending[n]
+		if known || writing || n >= f.i.N {
+			continue
+		}
+		// another process sharing the root may still be writing it.
+		if fi, err := e.Info(); err != nil || time.Since(fi.ModTime()) < orphanAge {
+			continue
+		}
+		rep.Orphans = append(rep.Orphans, n)
+	}
+	sort.Slice(rep.Orphans, func(a, b int) bool { return rep.Orphans[a] < rep.Orphans[b] })
+
+	return rep, nil
+}
+
+// checkKey fails if any sector in service is encrypted but no master key is
+// loaded, as their data can't be verified.
+func (f *filestore) checkKey() error {
+	if f.key != nil {
+		return nil
+	}
+	encrypted := 0
+	for n := range f.snapshot().Metadata {
+		if sm, err := f.readSidecar(n); err == nil && sm.Encryption != nil {
+			encrypted++
+		}
+	}
+	if encrypted > 0 {
+		return fmt.Errorf("%d sectors are encrypted, but no master key is loaded; pass --master-key-file or set %s", encrypted, masterKeyEnv)
+	}
+	return nil
+}
+
+// scrub periodically checks the store in the background, optionally
+// quarantining sectors that fail verification.
+func (f *filestore) scrub(ctx context.Context, interval time.Duration, quarantine bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		// each run gets its own ID, as a request would.
+		ctx := withRequestID(ctx)
+		log := requestLogger(ctx, storeLog).With("root", f.root)
+		rep, err := f.Check(ctx, true)
+		if err != nil {
+			log.Errorw("scrub failed", "error", err)
+			continue
+		}
+		for n, reason := range rep.Bad {
+			log.Warnw("scrub: bad sector", "sector", n, "reason", reason)
+			if quarantine {
+				if err := f.Quarantine(ctx, n, reason); err != nil {
+					log.Errorw("scrub: failed to quarantine sector", "sector", n, "error", err)
+				}
+			}
+		}
+		for _, n := range rep.Orphans {
+			log.Warnw("scrub: orphaned data with no metadata", "sector", n)
+		}
+		for n, reason := range rep.Unchecked {
+			log.Errorw("scrub: could not check sector", "sector", n, "reason", reason)
+		}
+		log.Infow("scrub: checked sectors", "checked", rep.Checked, "bad", len(rep.Bad), "orphaned", len(rep.Orphans), "unchecked", len(rep.Unchecked))
+	}
+}
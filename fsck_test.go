@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHealthyStore(t *testing.T) {
+	for _, key := range []*masterKey{nil, testMasterKey(t, 1)} {
+		f, sectors := newFilledStore(t, key, 1, 2)
+		rep, err := f.Check(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Checked != len(sectors) || len(rep.Bad) > 0 || len(rep.Orphans) > 0 || len(rep.Unchecked) > 0 {
+			t.Fatalf("encrypted %t: %+v", key != nil, rep)
+		}
+	}
+}
+
+func TestCheckFindsBadSectors(t *testing.T) {
+	f, s := newFilledStore(t, nil, 1, 2, 3, 4)
+	os.Remove(f.sectorPath(s[0]))
+	os.Truncate(f.sectorPath(s[1]), 100)
+	b, _ := os.ReadFile(f.sectorPath(s[2]))
+	b[10] ^= 0xff
+	os.WriteFile(f.sectorPath(s[2]), b, 0660)
+
+	rep, err := f.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "bad", keys(rep.Bad), s[:3])
+	for n, prefix := range map[uint64]string{s[0]: "missing data", s[1]: "size", s[2]: "commp"} {
+		if !strings.HasPrefix(rep.Bad[n], prefix) {
+			t.Errorf("sector %d is bad as %q, want %s", n, rep.Bad[n], prefix)
+		}
+	}
+
+	// without recomputing CommP, only the size is checked.
+	rep, err = f.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "bad", keys(rep.Bad), s[:2])
+}
+
+func TestCheckFindsOrphans(t *testing.T) {
+	f, _ := newFilledStore(t, nil, 1)
+	// sectors 1 to 3 are reserved by uploads that haven't finished.
+	f.i.N += 3
+	stale := time.Now().Add(-orphanAge - time.Minute)
+	writePartial(t, f.sectorPath(1), stale)
+	writePartial(t, f.sectorPath(2), stale)
+	f.pending[2] = struct{}{}
+	// another process may be writing sector 3, or one it reserved since the
+	// index was loaded.
+	writePartial(t, f.sectorPath(3), time.Now())
+	writePartial(t, f.sectorPath(7), stale)
+
+	rep, err := f.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "orphaned", rep.Orphans, []uint64{1})
+}
+
+func TestCheckEncrypted(t *testing.T) {
+	f, s := newFilledStore(t, testMasterKey(t, 1), 1, 2)
+	b, _ := os.ReadFile(f.sectorPath(s[0]))
+	b[10] ^= 0xff
+	os.WriteFile(f.sectorPath(s[0]), b, 0660)
+
+	rep, err := f.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "bad", keys(rep.Bad), s[:1])
+
+	// sectors that can't be decrypted aren't known to be bad.
+	f.key = testMasterKey(t, 2)
+	rep, err = f.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "bad", keys(rep.Bad), nil)
+	assertSectors(t, "unchecked", keys(rep.Unchecked), s)
+	if err := f.checkKey(); err != nil {
+		t.Fatalf("checkKey with a master key: %v", err)
+	}
+
+	f.key = nil
+	rep, err = f.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "unchecked", keys(rep.Unchecked), s)
+	if err := f.checkKey(); err == nil {
+		t.Fatal("checkKey passed with encrypted sectors and no master key")
+	}
+}
+
+// writePartial writes a partial sector file last modified at mtime.
+func writePartial(t *testing.T, p string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(p, []byte("partial"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/docker/go-units"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/miner"
+	"github.com/filecoin-project/lotus/api"
+	lminer "github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v2"
+)
+
+// syntheticAddress is the miner actor used when none is configured.
+var syntheticAddress, _ = address.NewIDAddress(88)
+
+// minerIdentity is the miner this instance presents itself as. It is written
+// to miner.json in the store on first run, so it stays the same across restarts.
+type minerIdentity struct {
+	Actor            address.Address
+	Owner            address.Address
+	Worker           address.Address
+	ControlAddresses []address.Address
+	PeerID           *peer.ID `json:",omitempty"`
+	Multiaddrs       []string
+	SectorSize       abi.SectorSize
+}
+
+func identityPath(root string) string {
+	return path.Join(root, "miner.json")
+}
+
+// readIdentity reads the identity persisted in the store, or returns nil if there isn't one.
+func readIdentity(root string) (*minerIdentity, error) {
+	b, err := os.ReadFile(identityPath(root))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	id := &minerIdentity{}
+	if err := json.Unmarshal(b, id); err != nil {
+		return nil, fmt.Errorf("reading miner identity: %w", err)
+	}
+	return id, nil
+}
+
+// loadIdentity reads the identity persisted in the store, updated by any
+// identity flags that are set.
+func loadIdentity(ctx *cli.Context, root string, wallet api.Wallet) (*minerIdentity, error) {
+	return openIdentity(ctx.Context, root, syntheticAddress, wallet, func(id *minerIdentity) (changed bool, err error) {
+		for name, field := range map[string]*address.Address{
+			"miner-actor":  &id.Actor,
+			"miner-owner":  &id.Owner,
+			"miner-worker": &id.Worker,
+		} {
+			if !ctx.IsSet(name) {
+				continue
+			}
+			if *field, err = address.NewFromString(ctx.String(name)); err != nil {
+				return false, fmt.Errorf("--%s: %w", name, err)
+			}
+			changed = true
+		}
+		if ctx.IsSet("miner-control") {
+			id.ControlAddresses = nil
+			for _, s := range ctx.StringSlice("miner-control") {
+				a, err := address.NewFromString(s)
+				if err != nil {
+					return false, fmt.Errorf("--miner-control: %w", err)
+				}
+				id.ControlAddresses = append(id.ControlAddresses, a)
+			}
+			changed = true
+		}
+		if ctx.IsSet("miner-peer-id") {
+			pid, err := peer.Decode(ctx.String("miner-peer-id"))
+			if err != nil {
+				return false, fmt.Errorf("--miner-peer-id: %w", err)
+			}
+			id.PeerID = &pid
+			changed = true
+		}
+		if ctx.IsSet("miner-multiaddr") {
+			id.Multiaddrs = ctx.StringSlice("miner-multiaddr")
+			changed = true
+		}
+		if ctx.IsSet("sector-size") {
+			size, err := units.RAMInBytes(ctx.String("sector-size"))
+			if err != nil {
+				return false, fmt.Errorf("--sector-size: %w", err)
+			}
+			id.SectorSize = abi.SectorSize(size)
+			changed = true
+		}
+		return changed, nil
+	})
+}
+
+// openIdentity reads the identity persisted in the store at root, or starts
+// one for actor if there isn't one, and lets configure update it. Unset worker
+// and owner addresses default to the wallet's default address, or its first.
+func openIdentity(ctx context.Context, root string, actor address.Address, wallet api.Wallet, configure func(*minerIdentity) (bool, error)) (*minerIdentity, error) {
+	id, err := readIdentity(root)
+	if err != nil {
+		return nil, err
+	}
+	changed := id == nil
+	if id == nil {
+		id = &minerIdentity{Actor: actor, SectorSize: 32 << 30}
+	}
+	if configure != nil {
+		c, err := configure(id)
+		if err != nil {
+			return nil, err
+		}
+		changed = changed || c
+	}
+
+	if d, ok := wallet.(interface {
+		GetDefault() (address.Address, error)
+	}); ok && id.Worker == address.Undef {
+		if a, err := d.GetDefault(); err == nil {
+			id.Worker = a
+			changed = true
+		}
+	}
+	if id.Worker == address.Undef {
+		addrs, err := wallet.WalletList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no worker address configured, and the wallet is empty")
+		}
+		id.Worker = addrs[0]
+		changed = true
+	}
+	if id.Owner == address.Undef {
+		id.Owner = id.Worker
+		changed = true
+	}
+
+	if err := id.validate(); err != nil {
+		return nil, err
+	}
+	if changed {
+		b, err := json.MarshalIndent(id, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(identityPath(root), b, 0660); err != nil {
+			return nil, err
+		}
+		serverLog.Infow("miner identity saved", "miner", id.Actor, "path", identityPath(root))
+	}
+	return id, nil
+}
+
+func (id *minerIdentity) validate() error {
+	if id.Actor.Protocol() != address.ID {
+		return fmt.Errorf("miner actor %s must be an ID address", id.Actor)
+	}
+	if _, err := lminer.WindowPoStProofTypeFromSectorSize(id.SectorSize); err != nil {
+		return err
+	}
+	for _, s := range id.Multiaddrs {
+		if _, err := multiaddr.NewMultiaddr(s); err != nil {
+			return fmt.Errorf("multiaddr %q: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// info describes the identity as the miner actor's state would, with
+// addresses resolved to ID addresses where the chain knows them.
+func (id *minerIdentity) info(ctx context.Context, fapi api.FullNode) (api.MinerInfo, error) {
+	proof, err := lminer.WindowPoStProofTypeFromSectorSize(id.SectorSize)
+	if err != nil {
+		return api.MinerInfo{}, err
+	}
+	partition, err := builtin.PoStProofWindowPoStPartitionSectors(proof)
+	if err != nil {
+		return api.MinerInfo{}, err
+	}
+	maddrs := make([]abi.Multiaddrs, 0, len(id.Multiaddrs))
+	for _, s := range id.Multiaddrs {
+		ma, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return api.MinerInfo{}, err
+		}
+		maddrs = append(maddrs, ma.Bytes())
+	}
+	control := make([]address.Address, 0, len(id.ControlAddresses))
+	for _, a := range id.ControlAddresses {
+		control = append(control, lookupID(ctx, fapi, a))
+	}
+	owner := lookupID(ctx, fapi, id.Owner)
+
+	return api.MinerInfo{
+		Owner:                      owner,
+		Worker:                     lookupID(ctx, fapi, id.Worker),
+		NewWorker:                  address.Undef,
+		ControlAddresses:           control,
+		WorkerChangeEpoch:          -1,
+		PeerId:                     id.PeerID,
+		Multiaddrs:                 maddrs,
+		WindowPoStProofType:        proof,
+		SectorSize:                 id.SectorSize,
+		WindowPoStPartitionSectors: partition,
+		ConsensusFaultElapsed:      -1,
+		Beneficiary:                owner,
+		BeneficiaryTerm: &miner.BeneficiaryTerm{
+			Quota:     big.Zero(),
+			UsedQuota: big.Zero(),
+		},
+	}, nil
+}
+
+// lookupID returns the ID address of a, or a itself if the chain doesn't know it.
+func lookupID(ctx context.Context, fapi api.FullNode, a address.Address) address.Address {
+	if a.Protocol() == address.ID {
+		return a
+	}
+	id, err := fapi.StateLookupID(ctx, a, types.EmptyTSK)
+	if err != nil {
+		return a
+	}
+	return id
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The internal wallet keeps its keys in keystore/ in the store, one file per
+// key, each sealed with AES-256-GCM under a key derived from a passphrase with
+// scrypt. The salt, and a check value to detect a wrong passphrase, are kept
+// in keystore/params.
+const (
+	keystorePassphraseEnv = "DUMBFILSTORE_KEYSTORE_PASSPHRASE"
+	keystoreCheck         = "dumbfilstore keystore"
+)
+
+var keyNameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type keystoreParams struct {
+	N, R, P int
+	Salt    []byte
+	// Check is keystoreCheck sealed under the derived key.
+	Check []byte
+}
+
+// fileKeystore is a types.KeyStore backed by encrypted files.
+type fileKeystore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+var _ types.KeyStore = (*fileKeystore)(nil)
+
+func openKeystore(dir string, passphrase []byte) (*fileKeystore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	paramsPath := path.Join(dir, "params")
+
+	params := keystoreParams{}
+	b, err := os.ReadFile(paramsPath)
+	exists := err == nil
+	if exists {
+		if err := json.Unmarshal(b, &params); err != nil {
+			return nil, fmt.Errorf("reading keystore params: %w", err)
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		params = keystoreParams{N: 1 << 15, R: 8, P: 1, Salt: make([]byte, 16)}
+		if _, err := rand.Read(params.Salt); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(passphrase, params.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	ks := &fileKeystore{dir, aead}
+
+	if exists {
+		if check, err := ks.open(params.Check, "params"); err != nil || string(check) != keystoreCheck {
+			return nil, fmt.Errorf("wrong passphrase for keystore %s", dir)
+		}
+		return ks, nil
+	}
+	if params.Check, err = ks.seal([]byte(keystoreCheck), "params"); err != nil {
+		return nil, err
+	}
+	if b, err = json.Marshal(params); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(paramsPath, b); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// seal encrypts data, bound to name so files can't be swapped.
+func (ks *fileKeystore) seal(data []byte, name string) ([]byte, error) {
+	nonce := make([]byte, ks.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return ks.aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func (ks *fileKeystore) open(sealed []byte, name string) ([]byte, error) {
+	ns := ks.aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, fmt.Errorf("malformed key file")
+	}
+	return ks.aead.Open(nil, sealed[:ns], sealed[ns:], []byte(name))
+}
+
+// keyPath encodes name so it is safe to use as a file name.
+func (ks *fileKeystore) keyPath(name string) string {
+	return path.Join(ks.dir, keyNameEncoding.EncodeToString([]byte(name)))
+}
+
+func (ks *fileKeystore) List() ([]string, error) {
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name, err := keyNameEncoding.DecodeString(e.Name())
+		if err != nil {
+			// params, and temporary files.
+			continue
+		}
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+func (ks *fileKeystore) Get(name string) (types.KeyInfo, error) {
+	b, err := os.ReadFile(ks.keyPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return types.KeyInfo{}, fmt.Errorf("%s: %w", name, types.ErrKeyInfoNotFound)
+	} else if err != nil {
+		return types.KeyInfo{}, err
+	}
+	plain, err := ks.open(b, name)
+	if err != nil {
+		return types.KeyInfo{}, fmt.Errorf("decrypting key %s: %w", name, err)
+	}
+	var ki types.KeyInfo
+	if err := json.Unmarshal(plain, &ki); err != nil {
+		return types.KeyInfo{}, err
+	}
+	return ki, nil
+}
+
+func (ks *fileKeystore) Put(name string, ki types.KeyInfo) error {
+	if _, err := os.Stat(ks.keyPath(name)); err == nil {
+		return fmt.Errorf("%s: %w", name, types.ErrKeyExists)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	plain, err := json.Marshal(ki)
+	if err != nil {
+		return err
+	}
+	sealed, err := ks.seal(plain, name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ks.keyPath(name), sealed)
+}
+
+func (ks *fileKeystore) Delete(name string) error {
+	err := os.Remove(ks.keyPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", name, types.ErrKeyInfoNotFound)
+	}
+	return err
+}
+
+// writeFileAtomic writes a private file via a temporary file, so it is never seen partially written.
+func writeFileAtomic(p string, data []byte) error {
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// loadPassphrase reads the keystore passphrase from path, or from the
+// environment if path is empty. An empty passphrase leaves keys effectively
+// unprotected, so it is refused unless insecure is set.
+func loadPassphrase(path string, insecure bool) ([]byte, error) {
+	passphrase := []byte(os.Getenv(keystorePassphraseEnv))
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = []byte(strings.TrimRight(string(b), "\r\n"))
+	}
+	if len(passphrase) == 0 {
+		if !insecure {
+			return nil, fmt.Errorf("the keystore needs a passphrase from --keystore-passphrase-file or %s, or --keystore-insecure to keep keys unprotected", keystorePassphraseEnv)
+		}
+		walletLog.Warn("the keystore has no passphrase, so keys are stored unprotected")
+	}
+	return passphrase, nil
+}
+
+// openInternalWallet opens the wallet backed by the keystore in root. An
+// empty keystore is seeded with the key from a .wallet file in the working
+// directory, where earlier versions kept it, or with a new key.
+func openInternalWallet(ctx context.Context, root string, passphrase []byte) (*wallet.LocalWallet, error) {
+	ks, err := openKeystore(path.Join(root, "keystore"), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	w, err := wallet.NewWallet(ks)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := w.WalletList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 0 {
+		return w, nil
+	}
+
+	pk, err := os.ReadFile(".wallet")
+	if errors.Is(err, os.ErrNotExist) {
+		a, err := w.WalletNew(ctx, types.KTSecp256k1)
+		if err != nil {
+			return nil, err
+		}
+		walletLog.Infow("created wallet key", "address", a)
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+	a, err := w.WalletImport(ctx, &types.KeyInfo{Type: types.KTSecp256k1, PrivateKey: pk})
+	if err != nil {
+		return nil, err
+	}
+	if err := w.SetDefault(a); err != nil {
+		return nil, err
+	}
+	walletLog.Infow("imported the key in .wallet, the file is no longer used", "address", a)
+	return w, nil
+}
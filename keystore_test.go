@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	withNewline := write("newline", "secret\n")
+	empty := write("empty", "\n")
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		env      string
+		insecure bool
+		want     string
+		fails    bool
+	}{
+		{name: "file", path: withNewline, want: "secret"},
+		{name: "file over environment", path: withNewline, env: "other", want: "secret"},
+		{name: "environment", env: "from env", want: "from env"},
+		{name: "none", fails: true},
+		{name: "empty file", path: empty, env: "other", fails: true},
+		{name: "none, insecure", insecure: true, want: ""},
+		{name: "missing file", path: filepath.Join(dir, "missing"), insecure: true, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(keystorePassphraseEnv, tc.env)
+			got, err := loadPassphrase(tc.path, tc.insecure)
+			if (err != nil) != tc.fails {
+				t.Fatalf("loadPassphrase: %v, want failure %v", err, tc.fails)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("passphrase %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeystorePassphrase(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := openKeystore(dir, []byte("right")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		passphrase string
+		ok         bool
+	}{
+		{"right", true},
+		{"wrong", false},
+		{"", false},
+	} {
+		if _, err := openKeystore(dir, []byte(tc.passphrase)); (err == nil) != tc.ok {
+			t.Errorf("opening with %q: %v, want success %v", tc.passphrase, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/urfave/cli/v2"
+)
+
+// endpoints groups the HTTP surfaces by the address they are served on, so
+// surfaces given the same address share a listener.
+type endpoints struct {
+	addrs   []string
+	muxes   map[string]*http.ServeMux
+	servers []*http.Server
+}
+
+func newEndpoints() *endpoints {
+	return &endpoints{muxes: make(map[string]*http.ServeMux)}
+}
+
+// at returns the mux served on addr.
+func (e *endpoints) at(addr string) *http.ServeMux {
+	if m, ok := e.muxes[addr]; ok {
+		return m
+	}
+	m := http.NewServeMux()
+	e.addrs = append(e.addrs, addr)
+	e.muxes[addr] = m
+	return m
+}
+
+// serve listens on every address before serving any of them, and returns
+// when one of them fails or ctx is done. Unix sockets are created with
+// socketMode, and don't use TLS.
+func (e *endpoints) serve(ctx context.Context, tlsConf *tls.Config, socketMode os.FileMode, wrap func(http.Handler) http.Handler) error {
+	listeners := make([]net.Listener, 0, len(e.addrs))
+	for _, addr := range e.addrs {
+		l, err := listen(addr, socketMode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if _, unix := unixSocketPath(addr); tlsConf != nil && !unix {
+			l = tls.NewListener(l, tlsConf)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		server := &http.Server{Handler: wrap(e.muxes[e.addrs[i]])}
+		e.servers = append(e.servers, server)
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// shutdown closes the listeners and waits for requests in progress to
+// finish, until ctx is done. Hijacked connections, such as websocket RPC
+// connections, aren't waited for.
+func (e *endpoints) shutdown(ctx context.Context) error {
+	errs := make(chan error, len(e.servers))
+	for _, server := range e.servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	var err error
+	for range e.servers {
+		if serr := <-errs; serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// listen opens a TCP listener on addr, or a unix socket if addr is unix://<path>.
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	p, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// a socket left behind by an earlier run would make listening fail.
+	if fi, err := os.Stat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(p, socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// unixSocketPath returns the socket path of a unix://<path> address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix://"), true
+}
+
+// socketMode parses --socket-mode.
+func socketMode(ctx *cli.Context) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(ctx.String("socket-mode"), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("--socket-mode: %w", err)
+	}
+	return os.FileMode(mode), nil
+}
+
+// retrievalAddr is the address sector data is served on.
+func retrievalAddr(ctx *cli.Context) string {
+	if ctx.IsSet("retrieval-listen") {
+		return ctx.String("retrieval-listen")
+	}
+	return ctx.String("listen")
+}
+
+// publicURL is the base of the sector URLs handed to clients: --public-url, or
+// else the retrieval address.
+func publicURL(ctx *cli.Context) string {
+	if ctx.IsSet("public-url") {
+		return strings.TrimSuffix(ctx.String("public-url"), "/")
+	}
+	addr := retrievalAddr(ctx)
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			serverLog.Warn("sector data is served on all interfaces, so its URLs use 127.0.0.1; set --public-url to advertise a reachable address")
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	return urlScheme(ctx) + "://" + addr
+}
+
+// apiInfo is the address of the JSON-RPC API in the form lotus clients take in
+// FULLNODE_API_INFO and MINER_API_INFO: a multiaddr, or a wss:// URL with TLS,
+// since lotus clients use URLs as given and only websockets carry channels.
+func apiInfo(ctx *cli.Context) (string, error) {
+	addr := ctx.String("listen")
+	if p, ok := unixSocketPath(addr); ok {
+		// lotus dials every multiaddr as ws://<addr>, which can't reach a socket.
+		return "", fmt.Errorf("--listen is the unix socket %s, which lotus clients can't connect to; listen on a [host]:port instead", p)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("--listen: %w", err)
+	}
+	ip := net.ParseIP(host)
+	if host == "" || ip != nil && ip.IsUnspecified() {
+		host, ip = "127.0.0.1", net.IPv4(127, 0, 0, 1)
+	}
+	if tlsEnabled(ctx) {
+		return "wss://" + net.JoinHostPort(host, port), nil
+	}
+	switch {
+	case ip == nil:
+		return fmt.Sprintf("/dns/%s/tcp/%s/http", host, port), nil
+	case ip.To4() != nil:
+		return fmt.Sprintf("/ip4/%s/tcp/%s/http", ip, port), nil
+	default:
+		return fmt.Sprintf("/ip6/%s/tcp/%s/http", ip, port), nil
+	}
+}
+
+// handleAdmin adds the administrative endpoints to mux, for admin tokens only.
+func handleAdmin(mux *http.ServeMux) {
+	mux.Handle("/debug/pprof/", requirePerm(api.PermAdmin, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", requirePerm(api.PermAdmin, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", requirePerm(api.PermAdmin, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", requirePerm(api.PermAdmin, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", requirePerm(api.PermAdmin, http.HandlerFunc(pprof.Trace)))
+}
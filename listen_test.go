@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	lotuscliutil "github.com/filecoin-project/lotus/cli/util"
+	"github.com/urfave/cli/v2"
+)
+
+func TestAPIInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string
+		// the address lotus clients dial for v1, or "" to skip checking it.
+		dial string
+	}{
+		{"unix socket", []string{"--listen", "unix:///tmp/dfs.sock"}, "", ""},
+		{"ipv4", []string{"--listen", "10.0.0.1:9091"}, "/ip4/10.0.0.1/tcp/9091/http", "ws://10.0.0.1:9091/rpc/v1"},
+		{"unspecified", []string{"--listen", "0.0.0.0:9091"}, "/ip4/127.0.0.1/tcp/9091/http", "ws://127.0.0.1:9091/rpc/v1"},
+		{"no host", []string{"--listen", ":9091"}, "/ip4/127.0.0.1/tcp/9091/http", "ws://127.0.0.1:9091/rpc/v1"},
+		{"ipv6", []string{"--listen", "[::1]:9091"}, "/ip6/::1/tcp/9091/http", "ws://[::1]:9091/rpc/v1"},
+		{"dns", []string{"--listen", "store.example.com:9091"}, "/dns/store.example.com/tcp/9091/http", ""},
+		{"tls", []string{"--listen", "store.example.com:9091", "--tls-self-signed"}, "wss://store.example.com:9091", "wss://store.example.com:9091/rpc/v1"},
+		{"tls unspecified", []string{"--listen", ":9091", "--tls-cert", "tls.crt"}, "wss://127.0.0.1:9091", "wss://127.0.0.1:9091/rpc/v1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			fs.String("listen", "", "")
+			fs.String("tls-cert", "", "")
+			fs.Bool("tls-self-signed", false, "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			got, err := apiInfo(cli.NewContext(cli.NewApp(), fs, nil))
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("gave %s, which lotus dials as %s", got, dialArgs(t, got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+			if tc.dial == "" {
+				return
+			}
+			if dial := dialArgs(t, got); dial != tc.dial {
+				t.Fatalf("lotus dials %s, want %s", dial, tc.dial)
+			}
+		})
+	}
+}
+
+// dialArgs is the address lotus clients dial for the v1 API at addr.
+func dialArgs(t *testing.T, addr string) string {
+	t.Helper()
+	dial, err := lotuscliutil.ParseApiInfo("header.payload.sig:" + addr).DialArgs("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dial
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	lotusclient "github.com/filecoin-project/lotus/api/client"
+	lotuscliutil "github.com/filecoin-project/lotus/cli/util"
+	"github.com/google/uuid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// Each subsystem logs under its own name, so their levels can be set separately.
+const logPrefix = "dfs/"
+
+var (
+	httpLog   = logging.Logger(logPrefix + "http")
+	rpcLog    = logging.Logger(logPrefix + "rpc")
+	storeLog  = logging.Logger(logPrefix + "store")
+	walletLog = logging.Logger(logPrefix + "wallet")
+	chainLog  = logging.Logger(logPrefix + "chain")
+	serverLog = logging.Logger(logPrefix + "server")
+)
+
+// setupLogging applies --log-json and --log-level. Other libraries' loggers
+// keep the level set by GOLOG_LOG_LEVEL.
+func setupLogging(ctx *cli.Context) error {
+	if ctx.Bool("log-json") {
+		cfg := logging.GetConfig()
+		cfg.Format = logging.JSONOutput
+		logging.SetupLogging(cfg)
+	}
+	if err := logging.SetLogLevelRegex("^"+logPrefix, ctx.String("log-level")); err != nil {
+		return fmt.Errorf("--log-level: %w", err)
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the HTTP request ctx belongs to, or "" if none.
+// RPC calls made over one websocket connection share its ID.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns l annotated with the request ctx belongs to.
+func requestLogger(ctx context.Context, l *logging.ZapEventLogger) *zap.SugaredLogger {
+	return l.With("request", requestID(ctx))
+}
+
+// withRequestID gives ctx a new request ID, for the work done on its behalf.
+func withRequestID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, uuid.New().String())
+}
+
+// logRequest gives each request an ID, returned in the X-Request-Id header,
+// and logs it once served.
+func logRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withRequestID(r.Context())
+		id := requestID(ctx)
+		w.Header().Set("X-Request-Id", id)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		httpLog.Debugw("request started", "request", id, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+		httpLog.Infow("request", "request", id, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+			"status", sw.status, "duration", time.Since(start))
+	})
+}
+
+// statusWriter records the status of a response, and lets websocket
+// connections take it over.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom keeps the underlying ResponseWriter's io.ReaderFrom in use when a
+// handler copies a body, as embedding the interface would hide it.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (sh *StorageHandler) LogList(ctx context.Context) ([]string, error) {
+	subs := logging.GetSubsystems()
+	sort.Strings(subs)
+	return subs, nil
+}
+
+func (sh *StorageHandler) LogSetLevel(ctx context.Context, subsystem, level string) error {
+	if err := logging.SetLogLevel(subsystem, level); err != nil {
+		return err
+	}
+	requestLogger(ctx, serverLog).Infow("log level changed", "subsystem", subsystem, "level", level)
+	return nil
+}
+
+var logCmd = &cli.Command{
+	Name:  "log",
+	Usage: "list and set the log levels of a running instance",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "rpc",
+			Usage:    "API of the instance, as token:address with a write token",
+			Required: true,
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list the logging subsystems",
+			Action: logAction(func(cctx *cli.Context, full api.FullNode) error {
+				subs, err := full.LogList(cctx.Context)
+				if err != nil {
+					return err
+				}
+				fmt.Println(strings.Join(subs, "\n"))
+				return nil
+			}),
+		},
+		{
+			Name:      "set-level",
+			Usage:     "set the level of the given subsystems, or of all of this service's",
+			ArgsUsage: "<debug|info|warn|error> [subsystem...]",
+			Action: logAction(func(cctx *cli.Context, full api.FullNode) error {
+				if !cctx.Args().Present() {
+					return fmt.Errorf("missing level argument")
+				}
+				subs := cctx.Args().Tail()
+				if len(subs) == 0 {
+					all, err := full.LogList(cctx.Context)
+					if err != nil {
+						return err
+					}
+					for _, s := range all {
+						if strings.HasPrefix(s, logPrefix) {
+							subs = append(subs, s)
+						}
+					}
+				}
+				for _, s := range subs {
+					if err := full.LogSetLevel(cctx.Context, s, cctx.Args().First()); err != nil {
+						return fmt.Errorf("%s: %w", s, err)
+					}
+				}
+				return nil
+			}),
+		},
+	},
+}
+
+// logAction runs fn with a client for the instance given by --rpc.
+func logAction(fn func(cctx *cli.Context, full api.FullNode) error) cli.ActionFunc {
+	return func(cctx *cli.Context) error {
+		info := lotuscliutil.ParseApiInfo(cctx.String("rpc"))
+		addr, err := info.DialArgs("v1")
+		if err != nil {
+			return err
+		}
+		full, closer, err := lotusclient.NewFullNodeRPCV1(cctx.Context, addr, info.AuthHeader())
+		if err != nil {
+			return err
+		}
+		defer closer()
+		return fn(cctx, full)
+	}
+}
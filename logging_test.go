@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+// loggedRequests collects what logRequest logs until the returned function is called.
+func loggedRequests(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	if err := logging.SetLogLevel(logPrefix+"http", "info"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logging.SetLogLevel(logPrefix+"http", zapcore.Level(logging.GetConfig().Level).String()) })
+
+	pipe := logging.NewPipeReader(logging.PipeLevel(logging.LevelInfo))
+	var (
+		wg      sync.WaitGroup
+		entries []map[string]interface{}
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dec := json.NewDecoder(pipe)
+		for {
+			var e map[string]interface{}
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			if e["logger"] == logPrefix+"http" && e["msg"] == "request" {
+				entries = append(entries, e)
+			}
+		}
+	}()
+	return func() []map[string]interface{} {
+		pipe.Close()
+		wg.Wait()
+		return entries
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	body := "sector data"
+	var ids []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, requestID(r.Context()))
+		w.WriteHeader(http.StatusPartialContent)
+		io.Copy(w, io.LimitReader(strings.NewReader(body), int64(len(body))))
+	})
+	mux.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, requestID(r.Context()))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		rw.Flush()
+	})
+	ts := httptest.NewServer(logRequest(mux))
+	defer ts.Close()
+	logged := loggedRequests(t)
+
+	resp, err := http.Get(ts.URL + "/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != body || resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got %d %q", resp.StatusCode, got)
+	}
+	if id := resp.Header.Get("X-Request-Id"); id == "" || id != ids[0] {
+		t.Fatalf("X-Request-Id %q, handler saw %q", id, ids[0])
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/upgrade", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade got status %d", resp.StatusCode)
+	}
+	ts.Close()
+
+	// each request is logged once, with the status the client got.
+	entries := logged()
+	want := map[string]float64{ids[0]: http.StatusPartialContent, ids[1]: http.StatusSwitchingProtocols}
+	if len(entries) != len(want) {
+		t.Fatalf("logged %d requests, want %d", len(entries), len(want))
+	}
+	for _, e := range entries {
+		id, _ := e["request"].(string)
+		if status, ok := want[id]; !ok || e["status"] != status {
+			t.Errorf("logged request %q with status %v", id, e["status"])
+		}
+	}
+}
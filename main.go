@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -15,26 +16,176 @@ func main() {
 			&cli.StringFlag{
 				Name:    "listen",
 				Aliases: []string{"l"},
-				Usage:   "[host]:port to listen on",
+				Usage:   "[host]:port to listen on, or unix://<path> to serve JSON-RPC on a unix socket",
 				Value:   "127.0.0.1:9091",
 			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "level to log at: debug, info, warn or error. Other libraries log at the level in GOLOG_LOG_LEVEL",
+				Value: "info",
+			},
+			&cli.BoolFlag{
+				Name:  "log-json",
+				Usage: "log as JSON",
+			},
+			&cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Usage: "how long to wait for uploads and downloads in progress when shutting down",
+				Value: time.Minute,
+			},
+			&cli.StringFlag{
+				Name:  "socket-mode",
+				Usage: "permissions of unix sockets listened on",
+				Value: "0660",
+			},
+			&cli.StringFlag{
+				Name:  "retrieval-listen",
+				Usage: "[host]:port to serve sector data on, if not --listen",
+			},
+			&cli.StringFlag{
+				Name:  "admin-listen",
+				Usage: "[host]:port to serve admin endpoints such as /debug/pprof on. Unset, they aren't served",
+			},
+			&cli.StringFlag{
+				Name:  "public-url",
+				Usage: "base URL clients fetch sector data from, e.g. https://store.example.com. Defaults to the address sector data is served on",
+			},
+			&cli.StringFlag{
+				Name:  "tls-cert",
+				Usage: "PEM certificate to serve TLS with",
+			},
+			&cli.StringFlag{
+				Name:  "tls-key",
+				Usage: "PEM private key of --tls-cert",
+			},
+			&cli.BoolFlag{
+				Name:  "tls-self-signed",
+				Usage: "serve TLS with a self-signed certificate created in the store, for development",
+			},
+			&cli.StringFlag{
+				Name:  "tls-client-ca",
+				Usage: "PEM CA certificates that clients must present a certificate from",
+			},
 			&cli.StringFlag{
 				Name:  "api",
-				Usage: "read only backing API for chain calls",
+				Usage: "read only backing API for chain calls, or 'mock' for an offline simulated chain",
 				Value: "/dns/api.chain.love/wss",
 			},
+			&cli.DurationFlag{
+				Name:  "mock-block-time",
+				Usage: "time between tipsets of the simulated chain when --api=mock",
+				Value: 30 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:  "fallback",
+				Usage: "forward FullNode methods that aren't implemented locally to the --api node",
+			},
+			&cli.StringSliceFlag{
+				Name:  "fallback-allow",
+				Usage: "methods to forward even though they need more than read permission, e.g. MpoolPush",
+			},
+			&cli.StringSliceFlag{
+				Name:  "fallback-deny",
+				Usage: "methods never to forward",
+			},
+			&cli.StringFlag{
+				Name:  "mpool",
+				Usage: "'synthetic' to sign messages without submitting them, or 'live' to estimate gas, assign nonces and push them to the --api node",
+				Value: "synthetic",
+			},
+			&cli.StringFlag{
+				Name:  "signing-policy",
+				Usage: "JSON file of rules limiting what the wallet signs. Decisions are logged to signing-audit in the store",
+			},
+			&cli.StringFlag{
+				Name:  "keystore-passphrase-file",
+				Usage: "file holding the passphrase of the internal wallet's keystore. Defaults to the " + keystorePassphraseEnv + " environment variable",
+			},
+			&cli.BoolFlag{
+				Name:  "keystore-insecure",
+				Usage: "allow an empty keystore passphrase, leaving wallet keys unprotected",
+			},
+			&cli.StringFlag{
+				Name:  "sim-balance",
+				Usage: "starting balance of the miner actor and each wallet address with --mpool=synthetic",
+				Value: "1000 FIL",
+			},
 			&cli.StringFlag{
 				Name:  "wallet",
-				Usage: "backing API for wallet calls - or internal to maintain a local keypair",
+				Usage: "backing API for wallet calls - or internal to keep keys in an encrypted keystore in the store",
 				Value: "internal",
 			},
+			&cli.StringFlag{
+				Name:  "miner-actor",
+				Usage: "ID address of the miner actor to present as. Defaults to " + syntheticAddress.String(),
+			},
+			&cli.StringFlag{
+				Name:  "miner-owner",
+				Usage: "owner address of the miner. Defaults to the worker address",
+			},
+			&cli.StringFlag{
+				Name:  "miner-worker",
+				Usage: "worker address of the miner. Defaults to the default wallet address",
+			},
+			&cli.StringSliceFlag{
+				Name:  "miner-control",
+				Usage: "control addresses of the miner",
+			},
+			&cli.StringFlag{
+				Name:  "miner-peer-id",
+				Usage: "libp2p peer ID of the miner",
+			},
+			&cli.StringSliceFlag{
+				Name:  "miner-multiaddr",
+				Usage: "multiaddrs the miner is reachable at",
+			},
+			&cli.StringFlag{
+				Name:  "sector-size",
+				Usage: "sector size of the miner, e.g. 32GiB",
+			},
+			&cli.StringSliceFlag{
+				Name:  "extra-miner",
+				Usage: "ID address of another miner to host. Its sectors are kept under miners/<actor> in the store, and its API is served at /rpc/v0/<actor> and /rpc/v1/<actor>",
+			},
 			&cli.StringFlag{
 				Name:  "root",
 				Usage: "where to store data",
 				Value: "./.filstore",
 			},
+			&cli.BoolFlag{
+				Name:  "compress",
+				Usage: "store new pieces compressed with seekable zstd",
+			},
+			&cli.BoolFlag{
+				Name:  "encrypt",
+				Usage: "store new pieces encrypted under the master key",
+			},
+			&cli.StringFlag{
+				Name:  "master-key-file",
+				Usage: "file holding the hex encoded master key for piece encryption. Defaults to the " + masterKeyEnv + " environment variable",
+			},
+			&cli.DurationFlag{
+				Name:  "scrub-interval",
+				Usage: "how often to verify stored pieces in the background (0 to disable)",
+			},
+			&cli.BoolFlag{
+				Name:  "scrub-quarantine",
+				Usage: "stop serving sectors that fail background verification",
+			},
 		},
+		Before: setupLogging,
 		Action: Serve,
+		Commands: []*cli.Command{
+			backupCmd,
+			restoreCmd,
+			fsckCmd,
+			reindexCmd,
+			statsCmd,
+			rotateKeyCmd,
+			walletCmd,
+			authCmd,
+			logCmd,
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
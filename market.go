@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// marketSim simulates the storage market actor for messages sent through the
+// local message pool, tracking escrow and deals so boost sees the effects of
+// the messages it sends. It also tracks what those messages spend from the
+// local accounts. Its state is rebuilt by replaying the message log.
+type marketSim struct {
+	api api.FullNode
+	// initial is the balance each local account starts with.
+	initial abi.TokenAmount
+
+	l      sync.Mutex
+	escrow map[address.Address]abi.TokenAmount
+	locked map[address.Address]abi.TokenAmount
+	deals  map[abi.DealID]*api.MarketDeal
+	nextID abi.DealID
+	// the net amount each account has received from simulated messages.
+	flows map[address.Address]abi.TokenAmount
+}
+
+func newMarketSim(upstream api.FullNode, initial abi.TokenAmount) *marketSim {
+	return &marketSim{
+		api:     upstream,
+		initial: initial,
+		escrow:  make(map[address.Address]abi.TokenAmount),
+		locked:  make(map[address.Address]abi.TokenAmount),
+		deals:   make(map[abi.DealID]*api.MarketDeal),
+		nextID:  1,
+		flows:   make(map[address.Address]abi.TokenAmount),
+	}
+}
+
+// apply executes msg at the given height and returns its receipt.
+func (m *marketSim) apply(ctx context.Context, msg *types.Message, height abi.ChainEpoch) types.MessageReceipt {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.execute(ctx, msg, height)
+}
+
+// call executes msg at the given height without changing the simulated state.
+func (m *marketSim) call(ctx context.Context, msg *types.Message, height abi.ChainEpoch) types.MessageReceipt {
+	m.l.Lock()
+	scratch := &marketSim{
+		api:     m.api,
+		initial: m.initial,
+		escrow:  make(map[address.Address]abi.TokenAmount, len(m.escrow)),
+		locked:  make(map[address.Address]abi.TokenAmount, len(m.locked)),
+		deals:   make(map[abi.DealID]*api.MarketDeal, len(m.deals)),
+		nextID:  m.nextID,
+		flows:   make(map[address.Address]abi.TokenAmount, len(m.flows)),
+	}
+	for a, v := range m.escrow {
+		scratch.escrow[a] = v
+	}
+	for a, v := range m.locked {
+		scratch.locked[a] = v
+	}
+	for id, d := range m.deals {
+		scratch.deals[id] = d
+	}
+	for a, v := range m.flows {
+		scratch.flows[a] = v
+	}
+	m.l.Unlock()
+
+	return scratch.execute(ctx, msg, height)
+}
+
+// execute applies msg to the state. The caller must hold the lock.
+func (m *marketSim) execute(ctx context.Context, msg *types.Message, height abi.ChainEpoch) types.MessageReceipt {
+	rct := m.invoke(ctx, msg, height)
+
+	// the sender pays the most the message could cost in gas, and its value
+	// moves only if it succeeds. Value sent to the market actor is held in escrow.
+	from := m.resolve(ctx, msg.From)
+	m.flows[from] = big.Sub(m.balance(m.flows, from), msg.RequiredFunds())
+	if rct.ExitCode == exitcode.Ok {
+		m.flows[from] = big.Sub(m.balance(m.flows, from), msg.Value)
+		if msg.To != builtin.StorageMarketActorAddr {
+			to := m.resolve(ctx, msg.To)
+			m.flows[to] = big.Add(m.balance(m.flows, to), msg.Value)
+		}
+	}
+	return rct
+}
+
+// invoke runs the actor method msg calls. The caller must hold the lock.
+func (m *marketSim) invoke(ctx context.Context, msg *types.Message, height abi.ChainEpoch) types.MessageReceipt {
+	if msg.To != builtin.StorageMarketActorAddr {
+		return types.MessageReceipt{ExitCode: exitcode.Ok}
+	}
+
+	var ret cbg.CBORMarshaler
+	var code exitcode.ExitCode
+	switch msg.Method {
+	case builtin.MethodsMarket.AddBalance:
+		ret, code = m.addBalance(ctx, msg)
+	case builtin.MethodsMarket.WithdrawBalance:
+		ret, code = m.withdrawBalance(ctx, msg)
+	case builtin.MethodsMarket.PublishStorageDeals:
+		ret, code = m.publishStorageDeals(ctx, msg, height)
+	default:
+		code = exitcode.SysErrInvalidMethod
+	}
+
+	rct := types.MessageReceipt{ExitCode: code}
+	if ret != nil {
+		buf := new(bytes.Buffer)
+		if err := ret.MarshalCBOR(buf); err != nil {
+			return types.MessageReceipt{ExitCode: exitcode.ErrSerialization}
+		}
+		rct.Return = buf.Bytes()
+	}
+	return rct
+}
+
+// decodeReturn decodes the return value of a market method run by the
+// simulation, as StateWaitMsg reports it in ReturnDec. It is nil for other messages.
+func decodeReturn(msg *types.Message, rct types.MessageReceipt) (interface{}, error) {
+	if msg.To != builtin.StorageMarketActorAddr || rct.ExitCode != exitcode.Ok || len(rct.Return) == 0 {
+		return nil, nil
+	}
+	var ret cbg.CBORUnmarshaler
+	switch msg.Method {
+	case builtin.MethodsMarket.WithdrawBalance:
+		ret = &abi.TokenAmount{}
+	case builtin.MethodsMarket.PublishStorageDeals:
+		ret = &market.PublishStorageDealsReturn{}
+	default:
+		return nil, nil
+	}
+	if err := ret.UnmarshalCBOR(bytes.NewReader(rct.Return)); err != nil {
+		return nil, fmt.Errorf("decoding return of method %d: %w", msg.Method, err)
+	}
+	return ret, nil
+}
+
+func (m *marketSim) addBalance(ctx context.Context, msg *types.Message) (cbg.CBORMarshaler, exitcode.ExitCode) {
+	var target address.Address
+	if err := target.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+		return nil, exitcode.ErrSerialization
+	}
+	if msg.Value.Sign() <= 0 {
+		return nil, exitcode.ErrIllegalArgument
+	}
+	target = m.resolve(ctx, target)
+	m.escrow[target] = big.Add(m.balance(m.escrow, target), msg.Value)
+	return nil, exitcode.Ok
+}
+
+func (m *marketSim) withdrawBalance(ctx context.Context, msg *types.Message) (cbg.CBORMarshaler, exitcode.ExitCode) {
+	var params market.WithdrawBalanceParams
+	if err := params.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+		return nil, exitcode.ErrSerialization
+	}
+	if params.Amount.Sign() < 0 {
+		return nil, exitcode.ErrIllegalArgument
+	}
+	target := m.resolve(ctx, params.ProviderOrClientAddress)
+
+	// like the actor, withdraw as much as is available, up to the amount requested.
+	// The actor pays a provider's withdrawal to its owner, but here it goes back to the address itself.
+	amount := big.Min(params.Amount, m.available(target))
+	m.escrow[target] = big.Sub(m.balance(m.escrow, target), amount)
+	m.flows[target] = big.Add(m.balance(m.flows, target), amount)
+	return &amount, exitcode.Ok
+}
+
+func (m *marketSim) publishStorageDeals(ctx context.Context, msg *types.Message, height abi.ChainEpoch) (cbg.CBORMarshaler, exitcode.ExitCode) {
+	var params market.PublishStorageDealsParams
+	if err := params.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+		return nil, exitcode.ErrSerialization
+	}
+
+	ret := &market.PublishStorageDealsReturn{}
+	valid := []uint64{}
+	for i, d := range params.Deals {
+		p := d.Proposal
+		client := m.resolve(ctx, p.Client)
+		provider := m.resolve(ctx, p.Provider)
+		if p.StartEpoch <= height || p.EndEpoch <= p.StartEpoch {
+			continue
+		}
+		if m.available(client).LessThan(p.ClientBalanceRequirement()) || m.available(provider).LessThan(p.ProviderBalanceRequirement()) {
+			continue
+		}
+		m.locked[client] = big.Add(m.balance(m.locked, client), p.ClientBalanceRequirement())
+		m.locked[provider] = big.Add(m.balance(m.locked, provider), p.ProviderBalanceRequirement())
+
+		id := m.nextID
+		m.nextID++
+		m.deals[id] = &api.MarketDeal{
+			Proposal: p,
+			State: market.DealState{
+				SectorStartEpoch: -1,
+				LastUpdatedEpoch: -1,
+				SlashEpoch:       -1,
+			},
+		}
+		ret.IDs = append(ret.IDs, id)
+		valid = append(valid, uint64(i))
+	}
+	if len(valid) == 0 {
+		return nil, exitcode.ErrIllegalArgument
+	}
+	ret.ValidDeals = bitfield.NewFromSet(valid)
+	return ret, exitcode.Ok
+}
+
+func (m *marketSim) balance(table map[address.Address]abi.TokenAmount, a address.Address) abi.TokenAmount {
+	if v, ok := table[a]; ok {
+		return v
+	}
+	return big.Zero()
+}
+
+func (m *marketSim) available(a address.Address) abi.TokenAmount {
+	return big.Sub(m.balance(m.escrow, a), m.balance(m.locked, a))
+}
+
+// resolve returns the ID address of a, so balances are keyed consistently.
+func (m *marketSim) resolve(ctx context.Context, a address.Address) address.Address {
+	return lookupID(ctx, m.api, a)
+}
+
+// marketBalance returns the escrow and locked balances of addr.
+func (m *marketSim) marketBalance(ctx context.Context, addr address.Address) api.MarketBalance {
+	addr = m.resolve(ctx, addr)
+	m.l.Lock()
+	defer m.l.Unlock()
+	return api.MarketBalance{
+		Escrow: m.balance(m.escrow, addr),
+		Locked: m.balance(m.locked, addr),
+	}
+}
+
+// accountBalance is the simulated balance of a local account.
+func (m *marketSim) accountBalance(ctx context.Context, addr address.Address) abi.TokenAmount {
+	addr = m.resolve(ctx, addr)
+	m.l.Lock()
+	defer m.l.Unlock()
+	return big.Add(m.initial, m.balance(m.flows, addr))
+}
+
+// afford checks the sender of msg can pay for it, as the mpool would.
+func (m *marketSim) afford(ctx context.Context, msg *types.Message) error {
+	need := big.Add(msg.Value, msg.RequiredFunds())
+	if have := m.accountBalance(ctx, msg.From); have.LessThan(need) {
+		return fmt.Errorf("not enough funds in %s: have %s, need %s", msg.From, types.FIL(have), types.FIL(need))
+	}
+	return nil
+}
+
+// totalEscrow is the balance held by the market actor.
+func (m *marketSim) totalEscrow() abi.TokenAmount {
+	m.l.Lock()
+	defer m.l.Unlock()
+	total := big.Zero()
+	for _, v := range m.escrow {
+		total = big.Add(total, v)
+	}
+	return total
+}
+
+// deal returns a copy of a deal published through the simulation.
+func (m *marketSim) deal(id abi.DealID) (*api.MarketDeal, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	d, ok := m.deals[id]
+	if !ok {
+		return nil, fmt.Errorf("deal %d not found", id)
+	}
+	cp := *d
+	return &cp, nil
+}
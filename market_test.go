@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func TestMarketSim(t *testing.T) {
+	client, _ := address.NewIDAddress(2001)
+	provider, _ := address.NewIDAddress(2002)
+	_, md := testPiece(t, 1)
+	prop := *md.DealProposal
+	prop.Client, prop.Provider = client, provider
+	prop.StartEpoch, prop.EndEpoch = 100, 200
+	prop.StoragePricePerEpoch = abi.NewTokenAmount(1)
+	prop.ProviderCollateral, prop.ClientCollateral = abi.NewTokenAmount(30), abi.NewTokenAmount(0)
+	// the client must lock 100 epochs at 1 each, and the provider its collateral of 30.
+
+	addBalance := func(a address.Address, v int64) *types.Message {
+		return &types.Message{From: a, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.AddBalance, Value: abi.NewTokenAmount(v), Params: cborParams(t, &a)}
+	}
+	withdraw := func(a address.Address, v int64) *types.Message {
+		return &types.Message{From: a, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.WithdrawBalance, Value: big.Zero(),
+			Params: cborParams(t, &market.WithdrawBalanceParams{ProviderOrClientAddress: a, Amount: abi.NewTokenAmount(v)})}
+	}
+	publish := func(props ...market.DealProposal) *types.Message {
+		params := &market.PublishStorageDealsParams{}
+		for _, p := range props {
+			params.Deals = append(params.Deals, market.ClientDealProposal{Proposal: p, ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: make([]byte, 65)}})
+		}
+		return &types.Message{From: provider, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.PublishStorageDeals, Value: big.Zero(), Params: cborParams(t, params)}
+	}
+	expired := prop
+	expired.StartEpoch = 5
+
+	type balances struct{ escrow, locked, account int64 }
+	for _, tc := range []struct {
+		name  string
+		msgs  []*types.Message
+		codes []exitcode.ExitCode
+		// balances of the client and provider afterwards, with gas left out.
+		client, provider balances
+		deals            int
+	}{
+		{
+			name:   "add balance",
+			msgs:   []*types.Message{addBalance(client, 150)},
+			codes:  []exitcode.ExitCode{exitcode.Ok},
+			client: balances{150, 0, 850}, provider: balances{0, 0, 1000},
+		},
+		{
+			name:   "add nothing",
+			msgs:   []*types.Message{addBalance(client, 0)},
+			codes:  []exitcode.ExitCode{exitcode.ErrIllegalArgument},
+			client: balances{0, 0, 1000}, provider: balances{0, 0, 1000},
+		},
+		{
+			name:   "withdraw up to what is available",
+			msgs:   []*types.Message{addBalance(client, 150), withdraw(client, 500)},
+			codes:  []exitcode.ExitCode{exitcode.Ok, exitcode.Ok},
+			client: balances{0, 0, 1000}, provider: balances{0, 0, 1000},
+		},
+		{
+			name:   "publish",
+			msgs:   []*types.Message{addBalance(client, 150), addBalance(provider, 50), publish(prop)},
+			codes:  []exitcode.ExitCode{exitcode.Ok, exitcode.Ok, exitcode.Ok},
+			client: balances{150, 100, 850}, provider: balances{50, 30, 950},
+			deals: 1,
+		},
+		{
+			name:   "locked funds can't be withdrawn",
+			msgs:   []*types.Message{addBalance(client, 150), addBalance(provider, 50), publish(prop), withdraw(client, 150)},
+			codes:  []exitcode.ExitCode{exitcode.Ok, exitcode.Ok, exitcode.Ok, exitcode.Ok},
+			client: balances{100, 100, 900}, provider: balances{50, 30, 950},
+			deals: 1,
+		},
+		{
+			name:   "publish without escrow",
+			msgs:   []*types.Message{addBalance(client, 150), publish(prop)},
+			codes:  []exitcode.ExitCode{exitcode.Ok, exitcode.ErrIllegalArgument},
+			client: balances{150, 0, 850}, provider: balances{0, 0, 1000},
+		},
+		{
+			name:   "only valid deals are published",
+			msgs:   []*types.Message{addBalance(client, 150), addBalance(provider, 50), publish(expired, prop)},
+			codes:  []exitcode.ExitCode{exitcode.Ok, exitcode.Ok, exitcode.Ok},
+			client: balances{150, 100, 850}, provider: balances{50, 30, 950},
+			deals: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			m := newMarketSim(&api.FullNodeStruct{}, abi.NewTokenAmount(1000))
+			for i, msg := range tc.msgs {
+				// gas is free, so only value moves the account balances.
+				msg.GasLimit, msg.GasFeeCap, msg.GasPremium = 0, big.Zero(), big.Zero()
+				if err := m.afford(ctx, msg); err != nil {
+					t.Fatal(err)
+				}
+				// call must agree with apply, and leave the state alone.
+				called := m.call(ctx, msg, 10)
+				if called.ExitCode != tc.codes[i] {
+					t.Fatalf("message %d: exit code %d, want %d", i, called.ExitCode, tc.codes[i])
+				}
+				if rct := m.apply(ctx, msg, 10); rct.ExitCode != called.ExitCode || string(rct.Return) != string(called.Return) {
+					t.Fatalf("message %d: applied receipt %+v, called %+v", i, rct, called)
+				}
+			}
+			for _, c := range []struct {
+				a    address.Address
+				want balances
+			}{{client, tc.client}, {provider, tc.provider}} {
+				mb := m.marketBalance(ctx, c.a)
+				got := balances{mb.Escrow.Int64(), mb.Locked.Int64(), m.accountBalance(ctx, c.a).Int64()}
+				if got != c.want {
+					t.Errorf("%s has escrow, locked, account %v, want %v", c.a, got, c.want)
+				}
+			}
+			if len(m.deals) != tc.deals {
+				t.Errorf("%d deals published, want %d", len(m.deals), tc.deals)
+			}
+			if _, err := m.deal(1); (err == nil) != (tc.deals > 0) {
+				t.Errorf("deal 1: %v", err)
+			}
+		})
+	}
+}
+
+func TestMarketSimAfford(t *testing.T) {
+	a, _ := address.NewIDAddress(2001)
+	m := newMarketSim(&api.FullNodeStruct{}, abi.NewTokenAmount(1000))
+	for _, tc := range []struct {
+		name  string
+		value int64
+		ok    bool
+	}{
+		{"within balance", 990, true},
+		{"balance and gas", 1000, false},
+		{"over balance", 2000, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &types.Message{From: a, To: a, Value: abi.NewTokenAmount(tc.value), GasLimit: 10, GasFeeCap: abi.NewTokenAmount(1), GasPremium: big.Zero()}
+			if err := m.afford(context.Background(), msg); (err == nil) != tc.ok {
+				t.Fatalf("afford: %v, want success %v", err, tc.ok)
+			}
+		})
+	}
+}
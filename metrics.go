@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of each store are labelled with its root.
+var (
+	rpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbfilstore_rpc_calls_total",
+		Help: "JSON-RPC calls, by method and outcome: ok, error or denied.",
+	}, []string{"method", "outcome"})
+	rpcFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbfilstore_rpc_fallback_total",
+		Help: "JSON-RPC calls forwarded to the upstream node by --fallback, by method.",
+	}, []string{"method"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dumbfilstore_rpc_duration_seconds",
+		Help:    "Time taken to serve JSON-RPC calls.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"method"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dumbfilstore_upstream_duration_seconds",
+		Help:    "Time taken by calls to the upstream node, by method and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"method", "outcome"})
+	ingestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbfilstore_ingest_bytes_total",
+		Help: "Piece data received.",
+	}, []string{"root"})
+	ingestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dumbfilstore_ingest_duration_seconds",
+		Help:    "Time taken to store pieces.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"root"})
+	retrievalBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbfilstore_retrieval_bytes_total",
+		Help: "Sector data sent by the /sector/ handler.",
+	}, []string{"root"})
+	retrievalRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbfilstore_retrieval_requests_total",
+		Help: "Requests for sector data, by whether they asked for a range.",
+	}, []string{"root", "ranged"})
+	indexSaveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dumbfilstore_index_save_duration_seconds",
+		Help:    "Time taken to write out the index.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"root"})
+)
+
+var (
+	piecesDesc     = prometheus.NewDesc("dumbfilstore_pieces", "Pieces stored.", []string{"root"}, nil)
+	pieceBytesDesc = prometheus.NewDesc("dumbfilstore_piece_bytes", "Unpadded size of the pieces stored.", []string{"root"}, nil)
+	diskUsageDesc  = prometheus.NewDesc("dumbfilstore_disk_usage_bytes", "Size of the files in the store, excluding the stores of extra miners.", []string{"root"}, nil)
+)
+
+// storeCollector reports the contents of the stores when scraped.
+type storeCollector struct {
+	stores []*filestore
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- piecesDesc
+	ch <- pieceBytesDesc
+	ch <- diskUsageDesc
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, f := range c.stores {
+		snap := f.snapshot()
+		var size uint64
+		for _, md := range snap.Metadata {
+			if md.DealProposal != nil {
+				size += uint64(md.DealProposal.PieceSize.Unpadded())
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(piecesDesc, prometheus.GaugeValue, float64(len(snap.Metadata)), f.root)
+		ch <- prometheus.MustNewConstMetric(pieceBytesDesc, prometheus.GaugeValue, float64(size), f.root)
+
+		var usage int64
+		err := filepath.WalkDir(f.root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && p == minersDir(f.root) {
+				return filepath.SkipDir
+			}
+			if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+				usage += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(diskUsageDesc, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(diskUsageDesc, prometheus.GaugeValue, float64(usage), f.root)
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus format.
+func metricsHandler(stores []*filestore) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcCalls, rpcFallbacks, rpcDuration, upstreamDuration,
+		ingestBytes, ingestDuration, retrievalBytes, retrievalRequests, indexSaveDuration,
+		&storeCollector{stores},
+	)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+// errorOutcome labels a call by whether the error it returned, the last of out, is nil.
+func errorOutcome(out []reflect.Value) string {
+	if len(out) > 0 && !out[len(out)-1].IsNil() {
+		return "error"
+	}
+	return "ok"
+}
+
+// timedFullNode wraps upstream so the time taken by each call is recorded.
+func timedFullNode(upstream api.FullNode) api.FullNode {
+	var out api.FullNodeStruct
+	uv := reflect.ValueOf(upstream)
+	for _, internal := range api.GetInternalStructs(&out) {
+		rint := reflect.ValueOf(internal).Elem()
+		for i := 0; i < rint.NumField(); i++ {
+			name := rint.Type().Field(i).Name
+			fn := uv.MethodByName(name)
+			rint.Field(i).Set(reflect.MakeFunc(rint.Type().Field(i).Type, func(args []reflect.Value) []reflect.Value {
+				start := time.Now()
+				res := fn.Call(args)
+				upstreamDuration.WithLabelValues(name, errorOutcome(res)).Observe(time.Since(start).Seconds())
+				return res
+			}))
+		}
+	}
+	return &out
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	c prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.c.Add(float64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	c prometheus.Counter
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.c.Add(float64(n))
+	return n, err
+}
+
+// ReadFrom counts the bytes copied by the underlying ResponseWriter, which
+// copies with its own io.ReaderFrom if it has one.
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.c.Add(float64(n))
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// readerFromRecorder records whether the body was copied with ReadFrom.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	body := strings.Repeat("sector data", 1000)
+
+	for _, tc := range []struct {
+		name string
+		// write sends body to w.
+		write func(w http.ResponseWriter) error
+		// whether the underlying ReadFrom should be used.
+		readFrom bool
+	}{
+		{"write", func(w http.ResponseWriter) error {
+			_, err := w.Write([]byte(body))
+			return err
+		}, false},
+		{"copy", func(w http.ResponseWriter) error {
+			_, err := io.Copy(w, io.LimitReader(strings.NewReader(body), int64(len(body))))
+			return err
+		}, true},
+		{"serve content", func(w http.ResponseWriter) error {
+			http.ServeContent(w, httptest.NewRequest(http.MethodGet, "/sector/0", nil), "0", time.Time{}, bytes.NewReader([]byte(body)))
+			return nil
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			c := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_bytes"})
+			w := &countingResponseWriter{rec, c}
+			if err := tc.write(w); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+
+			if rec.Body.String() != body {
+				t.Fatalf("sent %d bytes, want %d", rec.Body.Len(), len(body))
+			}
+			if got := testutil.ToFloat64(c); got != float64(len(body)) {
+				t.Fatalf("counted %v bytes, want %d", got, len(body))
+			}
+			if rec.readFrom != tc.readFrom {
+				t.Fatalf("used ReadFrom: %t, want %t", rec.readFrom, tc.readFrom)
+			}
+			if !rec.Flushed {
+				t.Fatal("not flushed")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/urfave/cli/v2"
+)
+
+// hostedMiner is a miner identity served by this instance, along with the
+// store holding its sectors.
+type hostedMiner struct {
+	identity *minerIdentity
+	store    *filestore
+	// prefix is appended to the RPC and sector paths of miners other than the
+	// primary, so each is served under its own namespace.
+	prefix string
+}
+
+// minersDir holds a store for each miner hosted alongside the primary one.
+func minersDir(root string) string {
+	return path.Join(root, "miners")
+}
+
+// openExtraMiners opens the store of each miner hosted alongside the primary
+// one: those already with a store under miners/, and any new ones given with
+// --extra-miner.
+func openExtraMiners(ctx *cli.Context, root string, primary *minerIdentity, wallet api.Wallet) ([]*hostedMiner, error) {
+	actors := make(map[address.Address]struct{})
+	entries, err := os.ReadDir(minersDir(root))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		a, err := address.NewFromString(e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("unexpected directory %s in %s", e.Name(), minersDir(root))
+		}
+		actors[a] = struct{}{}
+	}
+	for _, s := range ctx.StringSlice("extra-miner") {
+		a, err := address.NewFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("--extra-miner: %w", err)
+		}
+		actors[a] = struct{}{}
+	}
+
+	sorted := make([]address.Address, 0, len(actors))
+	for a := range actors {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+
+	miners := make([]*hostedMiner, 0, len(sorted))
+	for _, a := range sorted {
+		if a == primary.Actor {
+			return nil, fmt.Errorf("miner %s is already the primary miner", a)
+		}
+		store, err := openStoreAt(ctx, path.Join(minersDir(root), a.String()))
+		if err != nil {
+			return nil, err
+		}
+		id, err := openIdentity(ctx.Context, store.root, a, wallet, nil)
+		if err != nil {
+			return nil, err
+		}
+		if id.Actor != a {
+			return nil, fmt.Errorf("store for miner %s has the identity of %s", a, id.Actor)
+		}
+		miners = append(miners, &hostedMiner{id, store, "/" + a.String()})
+	}
+	return miners, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/node/modules/dtypes"
+	"github.com/ipfs/go-cid"
+)
+
+// mockCid stands in for state and message roots in simulated blocks.
+var mockCid, _ = abi.CidBuilder.Sum([]byte("dumbfilstore mock"))
+
+// mockChain is an in-process stand in for an upstream FullNode. It produces a
+// tipset every block time, and answers the chain and state calls made by boost
+// deterministically. Anything it does not implement returns api.ErrNotSupported.
+type mockChain struct {
+	api.FullNodeStruct
+
+	blockTime time.Duration
+	genesis   time.Time
+
+	l       sync.Mutex
+	tipsets []*types.TipSet
+	subs    map[chan []*api.HeadChange]struct{}
+	// key addresses that have been looked up, by their derived ID.
+	accounts map[address.Address]address.Address
+}
+
+func newMockChain(ctx context.Context, blockTime time.Duration) (*mockChain, func(), error) {
+	if blockTime <= 0 {
+		return nil, nil, fmt.Errorf("mock block time must be positive")
+	}
+	mc := &mockChain{
+		blockTime: blockTime,
+		genesis:   time.Now().Truncate(time.Second),
+		subs:      make(map[chan []*api.HeadChange]struct{}),
+		accounts:  make(map[address.Address]address.Address),
+	}
+	genesis, err := mc.mkTipSet(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	mc.tipsets = append(mc.tipsets, genesis)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go mc.run(ctx)
+	return mc, cancel, nil
+}
+
+func (mc *mockChain) run(ctx context.Context) {
+	t := time.NewTicker(mc.blockTime)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			mc.l.Lock()
+			for sub := range mc.subs {
+				close(sub)
+				delete(mc.subs, sub)
+			}
+			mc.l.Unlock()
+			return
+		case <-t.C:
+		}
+
+		mc.l.Lock()
+		ts, err := mc.mkTipSet(mc.tipsets[len(mc.tipsets)-1])
+		if err != nil {
+			mc.l.Unlock()
+			chainLog.Errorw("mock chain: failed to make tipset", "error", err)
+			continue
+		}
+		mc.tipsets = append(mc.tipsets, ts)
+		for sub := range mc.subs {
+			select {
+			case sub <- []*api.HeadChange{{Type: "apply", Val: ts}}:
+			default:
+				// drop subscribers that don't keep up, as lotus does.
+				close(sub)
+				delete(mc.subs, sub)
+			}
+		}
+		mc.l.Unlock()
+	}
+}
+
+// mkTipSet builds the single block tipset following parent.
+func (mc *mockChain) mkTipSet(parent *types.TipSet) (*types.TipSet, error) {
+	height := abi.ChainEpoch(0)
+	parents := []cid.Cid{}
+	if parent != nil {
+		height = parent.Height() + 1
+		parents = parent.Cids()
+	}
+	ticket := make([]byte, 8)
+	binary.BigEndian.PutUint64(ticket, uint64(height))
+
+	return types.NewTipSet([]*types.BlockHeader{{
+		Miner:                 syntheticAddress,
+		Ticket:                &types.Ticket{VRFProof: ticket},
+		ElectionProof:         &types.ElectionProof{WinCount: 1, VRFProof: ticket},
+		Parents:               parents,
+		ParentWeight:          types.NewInt(uint64(height)),
+		Height:                height,
+		ParentStateRoot:       mockCid,
+		ParentMessageReceipts: mockCid,
+		Messages:              mockCid,
+		BLSAggregate:          &crypto.Signature{Type: crypto.SigTypeBLS},
+		Timestamp:             uint64(mc.genesis.Add(time.Duration(height) * mc.blockTime).Unix()),
+		BlockSig:              &crypto.Signature{Type: crypto.SigTypeBLS},
+		ParentBaseFee:         abi.NewTokenAmount(100),
+	}})
+}
+
+func (mc *mockChain) Version(ctx context.Context) (api.APIVersion, error) {
+	return api.APIVersion{
+		Version:    "dumbfilstore-mock",
+		APIVersion: api.FullAPIVersion1,
+		BlockDelay: uint64(mc.blockTime.Seconds()),
+	}, nil
+}
+
+func (mc *mockChain) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	return mc.tipsets[len(mc.tipsets)-1], nil
+}
+
+func (mc *mockChain) ChainNotify(ctx context.Context) (<-chan []*api.HeadChange, error) {
+	sub := make(chan []*api.HeadChange, 16)
+
+	mc.l.Lock()
+	sub <- []*api.HeadChange{{Type: "current", Val: mc.tipsets[len(mc.tipsets)-1]}}
+	mc.subs[sub] = struct{}{}
+	mc.l.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		mc.l.Lock()
+		defer mc.l.Unlock()
+		if _, ok := mc.subs[sub]; ok {
+			close(sub)
+			delete(mc.subs, sub)
+		}
+	}()
+	return sub, nil
+}
+
+func (mc *mockChain) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	if tsk.IsEmpty() {
+		return mc.tipsets[len(mc.tipsets)-1], nil
+	}
+	for i := len(mc.tipsets) - 1; i >= 0; i-- {
+		if mc.tipsets[i].Key() == tsk {
+			return mc.tipsets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("tipset %s not found", tsk)
+}
+
+func (mc *mockChain) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	if h < 0 || int(h) >= len(mc.tipsets) {
+		return nil, fmt.Errorf("no tipset at height %d", h)
+	}
+	return mc.tipsets[h], nil
+}
+
+func (mc *mockChain) ChainGetTipSetAfterHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	return mc.ChainGetTipSetByHeight(ctx, h, tsk)
+}
+
+func (mc *mockChain) StateNetworkName(ctx context.Context) (dtypes.NetworkName, error) {
+	return "mocknet", nil
+}
+
+func (mc *mockChain) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error) {
+	return network.Version17, nil
+}
+
+// StateLookupID assigns each key address a stable ID derived from its hash.
+func (mc *mockChain) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	if addr.Protocol() == address.ID {
+		return addr, nil
+	}
+	h := fnv.New64a()
+	h.Write(addr.Bytes())
+	id, err := address.NewIDAddress(1000 + h.Sum64()%1_000_000_000)
+	if err != nil {
+		return address.Undef, err
+	}
+	mc.l.Lock()
+	mc.accounts[id] = addr
+	mc.l.Unlock()
+	return id, nil
+}
+
+func (mc *mockChain) StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	if addr.Protocol() != address.ID {
+		return addr, nil
+	}
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	if key, ok := mc.accounts[addr]; ok {
+		return key, nil
+	}
+	return address.Undef, fmt.Errorf("actor %s not found", addr)
+}
+
+func (mc *mockChain) StateMinerInfo(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	return api.MinerInfo{
+		Owner:                      addr,
+		Worker:                     addr,
+		SectorSize:                 abi.SectorSize(32 << 30),
+		WindowPoStProofType:        abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
+		WindowPoStPartitionSectors: 2349,
+		ConsensusFaultElapsed:      -1,
+	}, nil
+}
+
+func (mc *mockChain) StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	return &types.Actor{
+		Code:    mockCid,
+		Head:    mockCid,
+		Balance: big.Zero(),
+	}, nil
+}
+
+func (mc *mockChain) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	return big.Zero(), nil
+}
+
+func (mc *mockChain) StateMarketDeals(ctx context.Context, tsk types.TipSetKey) (map[string]*api.MarketDeal, error) {
+	return map[string]*api.MarketDeal{}, nil
+}
+
+func (mc *mockChain) StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error) {
+	return nil, nil
+}
+
+func (mc *mockChain) MpoolGetNonce(ctx context.Context, addr address.Address) (uint64, error) {
+	return 0, nil
+}
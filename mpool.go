@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+// defaultMaxFee caps the gas fee of a message when its send spec doesn't, matching lotus.
+var defaultMaxFee = abi.TokenAmount(types.MustParseFIL("0.07"))
+
+// messagePool handles the messages boost asks us to send.
+type messagePool interface {
+	// push prepares msg for sending, signs it with sign, and sends it.
+	push(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, sign func(context.Context, *types.Message) (*types.SignedMessage, error)) (*types.SignedMessage, error)
+	// pending lists messages that have been sent but not yet included in the chain.
+	pending(ctx context.Context, tsk types.TipSetKey) ([]*types.SignedMessage, error)
+	// wait returns once a message has been included with the given confidence.
+	wait(ctx context.Context, c cid.Cid, confidence uint64) (*api.MsgLookup, error)
+}
+
+// localPool records messages signed in synthetic mode to a log in the store,
+// and simulates their inclusion in the tipset after the one they were pushed at.
+type localPool struct {
+	api    api.FullNode
+	path   string
+	market *marketSim
+
+	l      sync.Mutex
+	msgs   map[cid.Cid]*localMessage
+	nonces map[address.Address]uint64
+}
+
+// localMessage is an entry in the message log.
+type localMessage struct {
+	Message *types.SignedMessage
+	// the height of the simulated tipset the message is included in.
+	Height  abi.ChainEpoch
+	Receipt types.MessageReceipt
+}
+
+func openLocalPool(ctx context.Context, upstream api.FullNode, path string, balance abi.TokenAmount) (*localPool, error) {
+	lp := &localPool{
+		api:    upstream,
+		path:   path,
+		market: newMarketSim(upstream, balance),
+		msgs:   make(map[cid.Cid]*localMessage),
+		nonces: make(map[address.Address]uint64),
+	}
+
+	fi, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	dec := json.NewDecoder(fi)
+	for {
+		lm := &localMessage{}
+		if err := dec.Decode(lm); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading message log: %w", err)
+		}
+		lp.market.apply(ctx, &lm.Message.Message, lm.Height-1)
+		lp.record(lm)
+	}
+	return lp, nil
+}
+
+// record indexes a message by both its signed and unsigned CID. The caller must hold the lock.
+func (lp *localPool) record(lm *localMessage) {
+	lp.msgs[lm.Message.Cid()] = lm
+	lp.msgs[lm.Message.Message.Cid()] = lm
+	if lm.Message.Message.Nonce >= lp.nonces[lm.Message.Message.From] {
+		lp.nonces[lm.Message.Message.From] = lm.Message.Message.Nonce + 1
+	}
+}
+
+func (lp *localPool) push(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, sign func(context.Context, *types.Message) (*types.SignedMessage, error)) (*types.SignedMessage, error) {
+	head, err := lp.api.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lp.l.Lock()
+	defer lp.l.Unlock()
+
+	if err := lp.market.afford(ctx, msg); err != nil {
+		return nil, err
+	}
+	msg.Nonce = lp.nonces[msg.From]
+	smsg, err := sign(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	lm := &localMessage{
+		Message: smsg,
+		Height:  head.Height() + 1,
+		// the receipt is worked out before the message is logged, and only
+		// applied to the market state once it has been.
+		Receipt: lp.market.call(ctx, msg, head.Height()),
+	}
+
+	b, err := json.Marshal(lm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.OpenFile(lp.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	if _, err := fi.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+
+	lp.market.apply(ctx, msg, head.Height())
+	lp.record(lm)
+	return smsg, nil
+}
+
+func (lp *localPool) pending(ctx context.Context, tsk types.TipSetKey) ([]*types.SignedMessage, error) {
+	ts, err := lp.api.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	lp.l.Lock()
+	defer lp.l.Unlock()
+
+	out := []*types.SignedMessage{}
+	for c, lm := range lp.msgs {
+		if c == lm.Message.Cid() && lm.Height > ts.Height() {
+			out = append(out, lm.Message)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Message.From != out[j].Message.From {
+			return out[i].Message.From.String() < out[j].Message.From.String()
+		}
+		return out[i].Message.Nonce < out[j].Message.Nonce
+	})
+	return out, nil
+}
+
+func (lp *localPool) wait(ctx context.Context, c cid.Cid, confidence uint64) (*api.MsgLookup, error) {
+	lp.l.Lock()
+	lm, ok := lp.msgs[c]
+	lp.l.Unlock()
+	if !ok {
+		// messages we didn't sign are assumed to have succeeded.
+		return &api.MsgLookup{
+			Message: c,
+			Receipt: types.MessageReceipt{
+				ExitCode: exitcode.Ok,
+			},
+		}, nil
+	}
+
+	head, err := waitForHeight(ctx, lp.api, lm.Height+abi.ChainEpoch(confidence))
+	if err != nil {
+		return nil, err
+	}
+	ts, err := lp.api.ChainGetTipSetByHeight(ctx, lm.Height, head.Key())
+	if err != nil {
+		return nil, err
+	}
+	ret, err := decodeReturn(&lm.Message.Message, lm.Receipt)
+	if err != nil {
+		return nil, err
+	}
+	return &api.MsgLookup{
+		Message:   c,
+		Receipt:   lm.Receipt,
+		ReturnDec: ret,
+		TipSet:    ts.Key(),
+		Height:    ts.Height(),
+	}, nil
+}
+
+// waitForHeight returns the chain head once it reaches height h.
+func waitForHeight(ctx context.Context, fapi api.FullNode, h abi.ChainEpoch) (*types.TipSet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changes, err := fapi.ChainNotify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for hcs := range changes {
+		for _, hc := range hcs {
+			if hc.Type != "revert" && hc.Val.Height() >= h {
+				return hc.Val, nil
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("chain notifications closed before height %d", h)
+}
+
+// livePool submits messages to the upstream node, assigning nonces and
+// estimating gas as the lotus message pool would.
+type livePool struct {
+	api api.FullNode
+
+	l sync.Mutex
+	// the next nonce for each sender, covering messages the upstream mpool hasn't seen yet.
+	nonces map[address.Address]uint64
+}
+
+func newLivePool(upstream api.FullNode) *livePool {
+	return &livePool{api: upstream, nonces: make(map[address.Address]uint64)}
+}
+
+// push prepares msg for submission with sign, and pushes it upstream.
+func (lp *livePool) push(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, sign func(context.Context, *types.Message) (*types.SignedMessage, error)) (*types.SignedMessage, error) {
+	from, err := lp.api.StateAccountKey(ctx, msg.From, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+	msg.From = from
+
+	lp.l.Lock()
+	defer lp.l.Unlock()
+
+	nonce, err := lp.api.MpoolGetNonce(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	if local, ok := lp.nonces[from]; ok && local > nonce {
+		nonce = local
+	}
+	msg.Nonce = nonce
+
+	msg, err = lp.api.GasEstimateMessageGas(ctx, msg, spec, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+	capGasFee(msg, spec)
+
+	smsg, err := sign(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lp.api.MpoolPush(ctx, smsg); err != nil {
+		return nil, err
+	}
+	lp.nonces[from] = nonce + 1
+	return smsg, nil
+}
+
+// pending lists the messages in the upstream mpool from senders we have pushed messages for.
+func (lp *livePool) pending(ctx context.Context, tsk types.TipSetKey) ([]*types.SignedMessage, error) {
+	msgs, err := lp.api.MpoolPending(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	lp.l.Lock()
+	defer lp.l.Unlock()
+
+	out := []*types.SignedMessage{}
+	for _, m := range msgs {
+		if _, ok := lp.nonces[m.Message.From]; ok {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func (lp *livePool) wait(ctx context.Context, c cid.Cid, confidence uint64) (*api.MsgLookup, error) {
+	return lp.api.StateWaitMsg(ctx, c, confidence, api.LookbackNoLimit, true)
+}
+
+// capGasFee limits the total gas fee of msg to the max fee of spec, as lotus' messagepool.CapGasFee does.
+func capGasFee(msg *types.Message, spec *api.MessageSendSpec) {
+	maxFee := defaultMaxFee
+	if spec != nil && spec.MaxFee.Int != nil && !spec.MaxFee.IsZero() {
+		maxFee = spec.MaxFee
+	}
+
+	gl := types.NewInt(uint64(msg.GasLimit))
+	if big.Mul(msg.GasFeeCap, gl).LessThanEqual(maxFee) {
+		return
+	}
+	msg.GasFeeCap = big.Div(maxFee, gl)
+	msg.GasPremium = big.Min(msg.GasFeeCap, msg.GasPremium)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestCapGasFee(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		feeCap, premium      int64
+		maxFee               *int64
+		wantCap, wantPremium int64
+	}{
+		{name: "under the default cap", feeCap: 100, premium: 50, wantCap: 100, wantPremium: 50},
+		{name: "over the default cap", feeCap: 1e9, premium: 1e9, wantCap: 7e7, wantPremium: 7e7},
+		{name: "premium under the new cap", feeCap: 1e9, premium: 100, wantCap: 7e7, wantPremium: 100},
+		{name: "zero max fee uses the default", feeCap: 1e9, premium: 1e9, maxFee: ptr(0), wantCap: 7e7, wantPremium: 7e7},
+		{name: "higher max fee", feeCap: 1e9, premium: 1e9, maxFee: ptr(1e18), wantCap: 1e9, wantPremium: 1e9},
+		{name: "lower max fee", feeCap: 1e9, premium: 1e9, maxFee: ptr(1e12), wantCap: 1e3, wantPremium: 1e3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a gas limit of 1e9 makes the default cap of 0.07 FIL a fee cap of 7e7.
+			msg := &types.Message{GasLimit: 1e9, GasFeeCap: big.NewInt(tc.feeCap), GasPremium: big.NewInt(tc.premium)}
+			var spec *api.MessageSendSpec
+			if tc.maxFee != nil {
+				spec = &api.MessageSendSpec{MaxFee: big.NewInt(*tc.maxFee)}
+			}
+			capGasFee(msg, spec)
+			if !msg.GasFeeCap.Equals(big.NewInt(tc.wantCap)) || !msg.GasPremium.Equals(big.NewInt(tc.wantPremium)) {
+				t.Fatalf("fee cap %s, premium %s, want %d, %d", msg.GasFeeCap, msg.GasPremium, tc.wantCap, tc.wantPremium)
+			}
+		})
+	}
+}
+
+func ptr(v int64) *int64 {
+	return &v
+}
+
+// liveUpstream is an upstream node that reports nonce for every sender.
+type liveUpstream struct {
+	api.FullNodeStruct
+	nonce  uint64
+	pushed []*types.SignedMessage
+}
+
+func (u *liveUpstream) StateAccountKey(ctx context.Context, a address.Address, tsk types.TipSetKey) (address.Address, error) {
+	return a, nil
+}
+
+func (u *liveUpstream) MpoolGetNonce(ctx context.Context, a address.Address) (uint64, error) {
+	return u.nonce, nil
+}
+
+func (u *liveUpstream) GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error) {
+	msg.GasLimit, msg.GasFeeCap, msg.GasPremium = 1000, big.NewInt(100), big.NewInt(10)
+	return msg, nil
+}
+
+func (u *liveUpstream) MpoolPush(ctx context.Context, smsg *types.SignedMessage) (cid.Cid, error) {
+	u.pushed = append(u.pushed, smsg)
+	return smsg.Cid(), nil
+}
+
+func TestLivePoolNonces(t *testing.T) {
+	from, _ := address.NewIDAddress(1001)
+	for _, tc := range []struct {
+		name string
+		// the upstream nonce before each push.
+		upstream []uint64
+		want     []uint64
+	}{
+		{"upstream sees each push", []uint64{0, 1, 2}, []uint64{0, 1, 2}},
+		{"upstream lags behind", []uint64{0, 0, 0}, []uint64{0, 1, 2}},
+		{"upstream moves ahead", []uint64{0, 0, 5}, []uint64{0, 1, 5}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &liveUpstream{}
+			lp := newLivePool(u)
+			for i, nonce := range tc.upstream {
+				u.nonce = nonce
+				smsg, err := lp.push(context.Background(), &types.Message{From: from, To: from, Value: abi.NewTokenAmount(1)}, nil, fakeSign)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if smsg.Message.Nonce != tc.want[i] {
+					t.Fatalf("push %d got nonce %d, want %d", i, smsg.Message.Nonce, tc.want[i])
+				}
+			}
+			if len(u.pushed) != len(tc.want) {
+				t.Fatalf("pushed %d messages upstream, want %d", len(u.pushed), len(tc.want))
+			}
+		})
+	}
+}
+
+func fakeSign(ctx context.Context, msg *types.Message) (*types.SignedMessage, error) {
+	return &types.SignedMessage{Message: *msg}, nil
+}
+
+func TestLocalPool(t *testing.T) {
+	ctx := context.Background()
+	mc, closer, err := newMockChain(ctx, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer()
+	head, err := mc.ChainHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := address.NewIDAddress(2001)
+	provider, _ := address.NewIDAddress(2002)
+	_, md := testPiece(t, 1)
+	prop := *md.DealProposal
+	prop.Client, prop.Provider = client, provider
+	prop.StartEpoch, prop.EndEpoch = head.Height()+1000, head.Height()+2000
+	prop.StoragePricePerEpoch = big.Zero()
+	prop.ProviderCollateral, prop.ClientCollateral = big.Zero(), big.Zero()
+
+	for _, tc := range []struct {
+		name    string
+		msg     *types.Message
+		code    exitcode.ExitCode
+		wantRet cbg.CBORMarshaler
+	}{
+		{
+			name: "send",
+			msg:  &types.Message{From: client, To: provider, Value: abi.NewTokenAmount(5)},
+		},
+		{
+			name: "add balance",
+			msg:  &types.Message{From: client, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.AddBalance, Value: abi.NewTokenAmount(100), Params: cborParams(t, &client)},
+		},
+		{
+			name:    "withdraw balance",
+			msg:     &types.Message{From: client, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.WithdrawBalance, Value: big.Zero(), Params: cborParams(t, &market.WithdrawBalanceParams{ProviderOrClientAddress: client, Amount: abi.NewTokenAmount(40)})},
+			wantRet: ptrTo(abi.NewTokenAmount(40)),
+		},
+		{
+			name: "publish storage deals",
+			msg: &types.Message{From: provider, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.PublishStorageDeals, Value: big.Zero(), Params: cborParams(t, &market.PublishStorageDealsParams{
+				Deals: []market.ClientDealProposal{{Proposal: prop, ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: make([]byte, 65)}}},
+			})},
+			wantRet: &market.PublishStorageDealsReturn{IDs: []abi.DealID{1}, ValidDeals: bitfield.NewFromSet([]uint64{0})},
+		},
+		{
+			name: "invalid method",
+			msg:  &types.Message{From: client, To: builtin.StorageMarketActorAddr, Method: 99, Value: big.Zero()},
+			code: exitcode.SysErrInvalidMethod,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp, err := openLocalPool(ctx, mc, filepath.Join(t.TempDir(), "messages"), types.FromFil(100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// escrow for the client, so there is something to withdraw.
+			pushForTest(t, lp, &types.Message{From: client, To: builtin.StorageMarketActorAddr, Method: builtin.MethodsMarket.AddBalance, Value: abi.NewTokenAmount(50), Params: cborParams(t, &client)})
+
+			smsg := pushForTest(t, lp, tc.msg)
+			ml, err := lp.wait(ctx, smsg.Cid(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ml.Receipt.ExitCode != tc.code {
+				t.Fatalf("exit code %d, want %d", ml.Receipt.ExitCode, tc.code)
+			}
+			if ml.Height <= head.Height() || ml.TipSet.IsEmpty() {
+				t.Fatalf("included at %d in %s, want a tipset after %d", ml.Height, ml.TipSet, head.Height())
+			}
+			if tc.wantRet == nil {
+				if ml.ReturnDec != nil {
+					t.Fatalf("ReturnDec %#v, want nil", ml.ReturnDec)
+				}
+				return
+			}
+			got, ok := ml.ReturnDec.(cbg.CBORMarshaler)
+			if !ok || !bytes.Equal(cborParams(t, got), cborParams(t, tc.wantRet)) {
+				t.Fatalf("ReturnDec %#v, want %#v", ml.ReturnDec, tc.wantRet)
+			}
+		})
+	}
+}
+
+func TestLocalPoolNonces(t *testing.T) {
+	ctx := context.Background()
+	// a chain that never moves, so messages stay pending.
+	mc, closer, err := newMockChain(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer()
+	a, _ := address.NewIDAddress(2001)
+	b, _ := address.NewIDAddress(2002)
+	log := filepath.Join(t.TempDir(), "messages")
+
+	for _, tc := range []struct {
+		name string
+		from address.Address
+		want uint64
+		// reopen rebuilds the pool from its log before pushing.
+		reopen bool
+	}{
+		{"first from a", a, 0, false},
+		{"second from a", a, 1, false},
+		{"first from b", b, 0, false},
+		{"third from a after a restart", a, 2, true},
+		{"second from b after a restart", b, 1, true},
+	} {
+		lp, err := openLocalPool(ctx, mc, log, types.FromFil(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		smsg := pushForTest(t, lp, &types.Message{From: tc.from, To: tc.from, Value: big.Zero()})
+		if smsg.Message.Nonce != tc.want {
+			t.Fatalf("%s: nonce %d, want %d", tc.name, smsg.Message.Nonce, tc.want)
+		}
+	}
+
+	lp, err := openLocalPool(ctx, mc, log, types.FromFil(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := lp.pending(ctx, types.EmptyTSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 5 {
+		t.Fatalf("%d messages pending, want 5", len(pending))
+	}
+}
+
+func pushForTest(t *testing.T, lp *localPool, msg *types.Message) *types.SignedMessage {
+	t.Helper()
+	msg.GasLimit, msg.GasFeeCap, msg.GasPremium = 1000, big.NewInt(100), big.NewInt(10)
+	smsg, err := lp.push(context.Background(), msg, nil, fakeSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return smsg
+}
+
+func cborParams(t *testing.T, v cbg.CBORMarshaler) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := v.MarshalCBOR(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func ptrTo(v abi.TokenAmount) *abi.TokenAmount {
+	return &v
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// policyRules is the signing policy file. Amounts are in FIL, e.g. "0.5 FIL",
+// and empty or zero rules don't restrict anything.
+type policyRules struct {
+	// AllowTypes lists the kinds of data that may be signed, e.g. "message" or "dealproposal".
+	AllowTypes []api.MsgType
+	// Recipients lists the addresses messages may be sent to.
+	Recipients []address.Address
+	// Methods lists the methods messages may call.
+	Methods []allowedMethod
+	// MaxValue caps the value of each message.
+	MaxValue string
+	// MaxFee caps the most each message could spend on gas.
+	MaxFee string
+	// SpendLimit caps the value and gas each address may spend within SpendPeriod.
+	SpendLimit  string
+	SpendPeriod string
+}
+
+// allowedMethod is a method that may be called, on To or on any actor if To is unset.
+type allowedMethod struct {
+	To     *address.Address `json:",omitempty"`
+	Method abi.MethodNum
+}
+
+// auditEntry records a signing decision.
+type auditEntry struct {
+	Time    time.Time
+	Signer  address.Address
+	Type    api.MsgType
+	To      *address.Address `json:",omitempty"`
+	Method  *abi.MethodNum   `json:",omitempty"`
+	Spend   *abi.TokenAmount `json:",omitempty"`
+	Allowed bool
+	Reason  string `json:",omitempty"`
+}
+
+// signingPolicy checks what the wallet is asked to sign against policyRules,
+// and writes each decision to an audit log. A nil policy allows everything.
+type signingPolicy struct {
+	rules    policyRules
+	maxValue abi.TokenAmount
+	maxFee   abi.TokenAmount
+	limit    abi.TokenAmount
+	period   time.Duration
+
+	l     sync.Mutex
+	audit *os.File
+	// messages signed within the spend period, oldest first.
+	spent []auditEntry
+}
+
+// loadSigningPolicy reads the rules at path and the audit log at auditPath,
+// so spending from before a restart still counts against the limit.
+func loadSigningPolicy(path, auditPath string) (*signingPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &signingPolicy{}
+	if err := json.Unmarshal(b, &p.rules); err != nil {
+		return nil, fmt.Errorf("reading signing policy: %w", err)
+	}
+	for _, amt := range []struct {
+		s   string
+		dst *abi.TokenAmount
+	}{{p.rules.MaxValue, &p.maxValue}, {p.rules.MaxFee, &p.maxFee}, {p.rules.SpendLimit, &p.limit}} {
+		*amt.dst = big.Zero()
+		if amt.s == "" {
+			continue
+		}
+		f, err := types.ParseFIL(amt.s)
+		if err != nil {
+			return nil, fmt.Errorf("signing policy: %w", err)
+		}
+		*amt.dst = abi.TokenAmount(f)
+	}
+	if p.rules.SpendPeriod != "" {
+		if p.period, err = time.ParseDuration(p.rules.SpendPeriod); err != nil {
+			return nil, fmt.Errorf("signing policy: %w", err)
+		}
+	}
+	if !p.limit.IsZero() && p.period == 0 {
+		return nil, fmt.Errorf("signing policy: SpendLimit needs a SpendPeriod")
+	}
+
+	if b, err := os.ReadFile(auditPath); err == nil {
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			var e auditEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				return nil, fmt.Errorf("reading signing audit log: %w", err)
+			}
+			if e.Allowed && e.Spend != nil {
+				p.spent = append(p.spent, e)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if p.audit, err = os.OpenFile(auditPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// check decides whether signer may sign toSign, described by meta.
+func (p *signingPolicy) check(ctx context.Context, signer address.Address, toSign []byte, meta api.MsgMeta) error {
+	if p == nil {
+		return nil
+	}
+	e := auditEntry{Time: time.Now(), Signer: signer, Type: meta.Type}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	reason := p.decide(&e, toSign, meta)
+	e.Allowed = reason == ""
+	e.Reason = reason
+
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = p.audit.Write(append(b, '\n'))
+	}
+	if err != nil {
+		// refuse to sign anything that can't be audited.
+		return fmt.Errorf("writing signing audit log: %w", err)
+	}
+	if !e.Allowed {
+		requestLogger(ctx, walletLog).Warnw("signing policy: refused", "type", meta.Type, "signer", signer, "reason", reason)
+		return fmt.Errorf("signing policy: %s", reason)
+	}
+	if e.Spend != nil {
+		p.spent = append(p.spent, e)
+	}
+	return nil
+}
+
+// decide fills in e and returns why the request is refused, or "" if it is
+// allowed. The caller must hold the lock.
+func (p *signingPolicy) decide(e *auditEntry, toSign []byte, meta api.MsgMeta) string {
+	listed := containsType(p.rules.AllowTypes, meta.Type)
+	if len(p.rules.AllowTypes) > 0 && !listed {
+		return fmt.Sprintf("signing %q data is not allowed", meta.Type)
+	}
+	switch meta.Type {
+	case api.MTChainMsg:
+		return p.decideMessage(e, toSign, meta)
+	case api.MTDealProposal:
+		return checkSigningBytes(&market.DealProposal{}, toSign, meta)
+	case api.MTBlock:
+		var blk types.BlockHeader
+		if reason := checkSigningBytes(&blk, toSign, meta); reason != "" {
+			return reason
+		}
+		if blk.BlockSig != nil {
+			return "block header is already signed"
+		}
+		return ""
+	}
+
+	// other types can't be checked, so they are only signed if listed, and
+	// never when the data could be signed as a type that can be.
+	if !listed {
+		return fmt.Sprintf("%q data can't be verified, and is only signed if listed in AllowTypes", meta.Type)
+	}
+	if _, err := cid.Cast(toSign); err == nil {
+		return fmt.Sprintf("%q data is a CID, as messages are signed by; sign it as a %q", meta.Type, api.MTChainMsg)
+	}
+	if decodesAs(&market.DealProposal{}, toSign) {
+		return fmt.Sprintf("%q data is a deal proposal; sign it as a %q", meta.Type, api.MTDealProposal)
+	}
+	if decodesAs(&types.BlockHeader{}, toSign) {
+		return fmt.Sprintf("%q data is a block header; sign it as a %q", meta.Type, api.MTBlock)
+	}
+	return ""
+}
+
+// signingType classifies data signed without a type, as deal proposals and
+// blocks are by clients of the full node API.
+func signingType(toSign []byte) api.MsgType {
+	if decodesAs(&market.DealProposal{}, toSign) {
+		return api.MTDealProposal
+	}
+	if decodesAs(&types.BlockHeader{}, toSign) {
+		return api.MTBlock
+	}
+	return api.MTUnknown
+}
+
+// cborValue is a CBOR encoded type.
+type cborValue interface {
+	cbg.CBORMarshaler
+	cbg.CBORUnmarshaler
+}
+
+// checkSigningBytes decodes toSign into v, refusing it unless it is exactly
+// the encoding of v, and it matches meta.Extra if that is set.
+func checkSigningBytes(v cborValue, toSign []byte, meta api.MsgMeta) string {
+	if len(meta.Extra) > 0 && !bytes.Equal(meta.Extra, toSign) {
+		return fmt.Sprintf("%q data does not match the data to sign", meta.Type)
+	}
+	if !decodesAs(v, toSign) {
+		return fmt.Sprintf("data to sign is not a %q", meta.Type)
+	}
+	return ""
+}
+
+// decodesAs reports whether b is exactly the encoding of a value of v's type, decoding it into v.
+func decodesAs(v cborValue, b []byte) bool {
+	if err := v.UnmarshalCBOR(bytes.NewReader(b)); err != nil {
+		return false
+	}
+	var buf bytes.Buffer
+	return v.MarshalCBOR(&buf) == nil && bytes.Equal(buf.Bytes(), b)
+}
+
+// decideMessage applies the message rules to a message signed by its CID.
+func (p *signingPolicy) decideMessage(e *auditEntry, toSign []byte, meta api.MsgMeta) string {
+	msg, err := types.DecodeMessage(meta.Extra)
+	if err != nil {
+		return fmt.Sprintf("undecodable message: %s", err)
+	}
+	if !bytes.Equal(msg.Cid().Bytes(), toSign) {
+		return "message does not match the data to sign"
+	}
+	spend := big.Add(msg.Value, msg.RequiredFunds())
+	e.To, e.Method, e.Spend = &msg.To, &msg.Method, &spend
+
+	if len(p.rules.Recipients) > 0 && !containsAddress(p.rules.Recipients, msg.To) {
+		return fmt.Sprintf("recipient %s is not allowed", msg.To)
+	}
+	if len(p.rules.Methods) > 0 {
+		allowed := false
+		for _, m := range p.rules.Methods {
+			if m.Method == msg.Method && (m.To == nil || *m.To == msg.To) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("method %d on %s is not allowed", msg.Method, msg.To)
+		}
+	}
+	if !p.maxValue.IsZero() && msg.Value.GreaterThan(p.maxValue) {
+		return fmt.Sprintf("value %s is over the limit of %s", types.FIL(msg.Value), types.FIL(p.maxValue))
+	}
+	if !p.maxFee.IsZero() && msg.RequiredFunds().GreaterThan(p.maxFee) {
+		return fmt.Sprintf("maximum fee %s is over the limit of %s", types.FIL(msg.RequiredFunds()), types.FIL(p.maxFee))
+	}
+	if !p.limit.IsZero() {
+		cutoff := e.Time.Add(-p.period)
+		for len(p.spent) > 0 && p.spent[0].Time.Before(cutoff) {
+			p.spent = p.spent[1:]
+		}
+		total := spend
+		for _, s := range p.spent {
+			if s.Signer == e.Signer {
+				total = big.Add(total, *s.Spend)
+			}
+		}
+		if total.GreaterThan(p.limit) {
+			return fmt.Sprintf("spending %s would exceed the limit of %s per %s", types.FIL(spend), types.FIL(p.limit), p.period)
+		}
+	}
+	return ""
+}
+
+func containsType(allowed []api.MsgType, t api.MsgType) bool {
+	for _, c := range allowed {
+		if c == t {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddress(addrs []address.Address, a address.Address) bool {
+	for _, c := range addrs {
+		if c == a {
+			return true
+		}
+	}
+	return false
+}
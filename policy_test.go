@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// newTestPolicy loads rules from a file in dir, with its audit log alongside.
+func newTestPolicy(t *testing.T, dir, rules string) *signingPolicy {
+	t.Helper()
+	p := path.Join(dir, "policy.json")
+	if err := os.WriteFile(p, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sp, err := loadSigningPolicy(p, path.Join(dir, "signing-audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.audit.Close() })
+	return sp
+}
+
+// signRequest is a request to sign data of a type, as WalletSign gets it.
+type signRequest struct {
+	toSign []byte
+	meta   api.MsgMeta
+}
+
+func messageRequest(t *testing.T, msg *types.Message) signRequest {
+	t.Helper()
+	extra, err := msg.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signRequest{msg.Cid().Bytes(), api.MsgMeta{Type: api.MTChainMsg, Extra: extra}}
+}
+
+// signingTestData returns a deal proposal from client, and a block mined by
+// miner as it is signed and once it has been.
+func signingTestData(t *testing.T, client, miner address.Address) (prop, blk, signedBlk []byte) {
+	t.Helper()
+	_, md := testPiece(t, 1)
+	prop = cborParams(t, &market.DealProposal{
+		PieceCID:             md.DealProposal.PieceCID,
+		PieceSize:            md.DealProposal.PieceSize,
+		Client:               client,
+		Provider:             miner,
+		StoragePricePerEpoch: big.Zero(),
+		ProviderCollateral:   big.Zero(),
+		ClientCollateral:     big.Zero(),
+	})
+	header := &types.BlockHeader{
+		Miner:                 miner,
+		ParentStateRoot:       md.DealProposal.PieceCID,
+		ParentMessageReceipts: md.DealProposal.PieceCID,
+		Messages:              md.DealProposal.PieceCID,
+		ParentWeight:          big.Zero(),
+		ParentBaseFee:         big.Zero(),
+	}
+	blk, err := header.SigningBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.BlockSig = &crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte{1}}
+	return prop, blk, cborParams(t, header)
+}
+
+func TestSigningPolicy(t *testing.T) {
+	signer, _ := address.NewIDAddress(1000)
+	market05, _ := address.NewIDAddress(5)
+	other, _ := address.NewIDAddress(6)
+
+	send := func(to address.Address, method abi.MethodNum, value string) *types.Message {
+		return &types.Message{
+			From:       signer,
+			To:         to,
+			Method:     method,
+			Value:      abi.TokenAmount(types.MustParseFIL(value)),
+			GasLimit:   1000000,
+			GasFeeCap:  abi.NewTokenAmount(100000000000),
+			GasPremium: abi.NewTokenAmount(1000),
+		}
+	}
+	propBytes, blkBytes, signedBlkBytes := signingTestData(t, signer, other)
+	msgCid := send(market05, 2, "1").Cid().Bytes()
+
+	for _, tc := range []struct {
+		name  string
+		rules string
+		req   signRequest
+		// whether the request is allowed.
+		allowed bool
+	}{
+		{"message", `{}`, messageRequest(t, send(market05, 2, "1")), true},
+		{"deal proposal", `{}`, signRequest{propBytes, api.MsgMeta{Type: api.MTDealProposal}}, true},
+		{"deal proposal in extra", `{}`, signRequest{propBytes, api.MsgMeta{Type: api.MTDealProposal, Extra: propBytes}}, true},
+		{"block", `{}`, signRequest{blkBytes, api.MsgMeta{Type: api.MTBlock}}, true},
+		{"unknown data", `{}`, signRequest{[]byte("ask"), api.MsgMeta{Type: api.MTUnknown}}, false},
+		{"unrecognised type", `{}`, signRequest{[]byte("ask"), api.MsgMeta{Type: "other"}}, false},
+		{"listed unknown data", `{"AllowTypes": ["unknown"]}`, signRequest{[]byte("ask"), api.MsgMeta{Type: api.MTUnknown}}, true},
+		{"message CID as unknown", `{"AllowTypes": ["unknown"]}`, signRequest{msgCid, api.MsgMeta{Type: api.MTUnknown}}, false},
+		{"deal proposal as unknown", `{"AllowTypes": ["unknown"]}`, signRequest{propBytes, api.MsgMeta{Type: api.MTUnknown}}, false},
+		{"block as unknown", `{"AllowTypes": ["unknown"]}`, signRequest{blkBytes, api.MsgMeta{Type: api.MTUnknown}}, false},
+		{"type not listed", `{"AllowTypes": ["message"]}`, signRequest{propBytes, api.MsgMeta{Type: api.MTDealProposal}}, false},
+		{"message CID as deal proposal", `{}`, signRequest{msgCid, api.MsgMeta{Type: api.MTDealProposal}}, false},
+		{"message CID as block", `{}`, signRequest{msgCid, api.MsgMeta{Type: api.MTBlock}}, false},
+		{"deal proposal not matching extra", `{}`, signRequest{propBytes, api.MsgMeta{Type: api.MTDealProposal, Extra: blkBytes}}, false},
+		{"signed block", `{}`, signRequest{signedBlkBytes, api.MsgMeta{Type: api.MTBlock}}, false},
+		{
+			name:  "message not matching extra",
+			rules: `{}`,
+			req: signRequest{
+				send(other, 0, "100").Cid().Bytes(),
+				messageRequest(t, send(market05, 2, "1")).meta,
+			},
+		},
+		{"recipient allowed", `{"Recipients": ["f05"]}`, messageRequest(t, send(market05, 2, "1")), true},
+		{"recipient refused", `{"Recipients": ["f05"]}`, messageRequest(t, send(other, 2, "1")), false},
+		{"method on actor allowed", `{"Methods": [{"To": "f05", "Method": 2}]}`, messageRequest(t, send(market05, 2, "1")), true},
+		{"method on other actor refused", `{"Methods": [{"To": "f05", "Method": 2}]}`, messageRequest(t, send(other, 2, "1")), false},
+		{"method on any actor", `{"Methods": [{"Method": 4}]}`, messageRequest(t, send(other, 4, "1")), true},
+		{"method refused", `{"Methods": [{"Method": 4}]}`, messageRequest(t, send(other, 2, "1")), false},
+		{"value under limit", `{"MaxValue": "1 FIL"}`, messageRequest(t, send(market05, 2, "1")), true},
+		{"value over limit", `{"MaxValue": "1 FIL"}`, messageRequest(t, send(market05, 2, "1.5")), false},
+		{"fee under limit", `{"MaxFee": "0.1 FIL"}`, messageRequest(t, send(market05, 2, "1")), true},
+		{"fee over limit", `{"MaxFee": "0.00001 FIL"}`, messageRequest(t, send(market05, 2, "1")), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPolicy(t, t.TempDir(), tc.rules)
+			err := p.check(context.Background(), signer, tc.req.toSign, tc.req.meta)
+			if tc.allowed && err != nil {
+				t.Fatalf("refused: %s", err)
+			} else if !tc.allowed && err == nil {
+				t.Fatal("allowed")
+			}
+		})
+	}
+}
+
+func TestSigningPolicySpendLimit(t *testing.T) {
+	dir := t.TempDir()
+	signer, _ := address.NewIDAddress(1000)
+	other, _ := address.NewIDAddress(1001)
+	to, _ := address.NewIDAddress(5)
+	rules := `{"SpendLimit": "3 FIL", "SpendPeriod": "1h"}`
+
+	send := func(from address.Address, value string) signRequest {
+		return messageRequest(t, &types.Message{From: from, To: to, Value: abi.TokenAmount(types.MustParseFIL(value))})
+	}
+	p := newTestPolicy(t, dir, rules)
+	for _, tc := range []struct {
+		from    address.Address
+		value   string
+		allowed bool
+	}{
+		{signer, "2", true},
+		{signer, "2", false},
+		{other, "2", true},
+		{signer, "1", true},
+		{signer, "0.1", false},
+	} {
+		req := send(tc.from, tc.value)
+		if err := p.check(context.Background(), tc.from, req.toSign, req.meta); (err == nil) != tc.allowed {
+			t.Fatalf("sending %s FIL from %s: allowed %t, want %t (%v)", tc.value, tc.from, err == nil, tc.allowed, err)
+		}
+	}
+
+	// spending before a restart still counts.
+	p = newTestPolicy(t, dir, rules)
+	req := send(signer, "0.1")
+	if err := p.check(context.Background(), signer, req.toSign, req.meta); err == nil {
+		t.Fatal("spend limit was reset by reloading the policy")
+	}
+	req = send(other, "1")
+	if err := p.check(context.Background(), other, req.toSign, req.meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalletSignPolicy(t *testing.T) {
+	ctx := context.Background()
+	w := newTestWallet(t)
+	signer, err := w.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := address.NewIDAddress(6)
+	prop, blk, signedBlk := signingTestData(t, signer, other)
+
+	// RPC callers can't give a type, so the data is checked as what it decodes as.
+	for _, tc := range []struct {
+		name    string
+		rules   string
+		toSign  []byte
+		allowed bool
+	}{
+		{"deal proposal", `{}`, prop, true},
+		{"block", `{}`, blk, true},
+		{"signed block", `{}`, signedBlk, false},
+		{"unknown data", `{}`, []byte("ask"), false},
+		{"listed unknown data", `{"AllowTypes": ["unknown"]}`, []byte("ask"), true},
+		{"deal proposal not listed", `{"AllowTypes": ["unknown"]}`, prop, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sh := &StorageHandler{wallet: w, policy: newTestPolicy(t, t.TempDir(), tc.rules)}
+			if _, err := sh.WalletSign(ctx, signer, tc.toSign); (err == nil) != tc.allowed {
+				t.Fatalf("allowed %t, want %t: %v", err == nil, tc.allowed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/filecoin-project/lotus/api"
+)
+
+// fallbackPolicy decides which FullNode methods without a local implementation
+// are forwarded to the upstream node. Methods requiring only read permission are
+// forwarded unless denied; anything else must be explicitly allowed.
+type fallbackPolicy struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func newFallbackPolicy(allow, deny []string) *fallbackPolicy {
+	p := &fallbackPolicy{make(map[string]bool), make(map[string]bool)}
+	for _, m := range allow {
+		p.allow[m] = true
+	}
+	for _, m := range deny {
+		p.deny[m] = true
+	}
+	return p
+}
+
+func (p *fallbackPolicy) permits(method string, perm string) bool {
+	if p.deny[method] {
+		return false
+	}
+	return perm == string(api.PermRead) || p.allow[method]
+}
+
+// fallbackProxy builds a FullNode that forwards the methods local does not
+// implement to upstream, as permitted by policy. Methods that are not forwarded
+// return api.ErrNotSupported. Registering it on an RPC server before local
+// leaves local's methods in place.
+func fallbackProxy(local interface{}, upstream api.FullNode, policy *fallbackPolicy) *api.FullNodeStruct {
+	var out api.FullNodeStruct
+	lv := reflect.ValueOf(local)
+	uv := reflect.ValueOf(upstream)
+
+	for _, internal := range api.GetInternalStructs(&out) {
+		rint := reflect.ValueOf(internal).Elem()
+		for i := 0; i < rint.NumField(); i++ {
+			field := rint.Type().Field(i)
+			if lv.MethodByName(field.Name).IsValid() {
+				continue
+			}
+			if !policy.permits(field.Name, field.Tag.Get("perm")) {
+				continue
+			}
+
+			name := field.Name
+			fn := uv.MethodByName(name)
+			rint.Field(i).Set(reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+				rpcFallbacks.WithLabelValues(name).Inc()
+				rpcLog.Debugw("fallback: forwarding upstream", "method", name)
+				return fn.Call(args)
+			}))
+		}
+	}
+	return &out
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFallbackProxyCountsForwardedCalls(t *testing.T) {
+	ctx := context.Background()
+	var upstream api.FullNodeStruct
+	upstream.Internal.ChainHead = func(ctx context.Context) (*types.TipSet, error) {
+		return nil, nil
+	}
+	forwarded := func(method string) float64 {
+		return testutil.ToFloat64(rpcFallbacks.WithLabelValues(method))
+	}
+	out := fallbackProxy(versionImpl{}, &upstream, newFallbackPolicy(nil, []string{"StateMinerSectorCount"}))
+
+	before := forwarded("ChainHead")
+	if _, err := out.ChainHead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := forwarded("ChainHead") - before; got != 1 {
+		t.Fatalf("forwarding ChainHead counted %v times, want 1", got)
+	}
+
+	// local methods, denied methods and write methods not allowed aren't forwarded.
+	calls := map[string]func() error{
+		"Version": func() error { _, err := out.Version(ctx); return err },
+		"StateMinerSectorCount": func() error {
+			_, err := out.StateMinerSectorCount(ctx, address.Undef, types.EmptyTSK)
+			return err
+		},
+		"MpoolClear": func() error { return out.MpoolClear(ctx, true) },
+	}
+	for method, call := range calls {
+		before := forwarded(method)
+		if err := call(); err == nil {
+			t.Errorf("%s succeeded", method)
+		}
+		if forwarded(method) != before {
+			t.Errorf("%s was counted as forwarded", method)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+var reindexCmd = &cli.Command{
+	Name:  "reindex",
+	Usage: "rebuild the index by matching piece files in the store to deals",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "deals",
+			Usage: "JSON file of deals, as output by StateMarketDeals. If unset, deals are read from the market state of the backing chain API",
+		},
+		&cli.StringFlag{
+			Name:  "miner",
+			Usage: "only match deals with this provider. Defaults to the miner actor in the store's miner.json",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "replace an existing, non-empty index",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		store, err := openStore(cctx)
+		if err != nil {
+			return err
+		}
+		if len(store.i.Metadata) > 0 && !cctx.Bool("force") {
+			return fmt.Errorf("store at %s already has an index with %d sectors, use --force to replace it", store.root, len(store.i.Metadata))
+		}
+		provider := syntheticAddress
+		if cctx.IsSet("miner") {
+			if provider, err = address.NewFromString(cctx.String("miner")); err != nil {
+				return fmt.Errorf("--miner: %w", err)
+			}
+		} else if id, err := readIdentity(store.root); err != nil {
+			return err
+		} else if id != nil {
+			provider = id.Actor
+		}
+
+		var deals map[string]*api.MarketDeal
+		if cctx.IsSet("deals") {
+			b, err := os.ReadFile(cctx.String("deals"))
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(b, &deals); err != nil {
+				return err
+			}
+		} else {
+			fapi, closer, err := dialFullNode(cctx)
+			if err != nil {
+				return err
+			}
+			defer closer()
+			if deals, err = fapi.StateMarketDeals(cctx.Context, types.EmptyTSK); err != nil {
+				return err
+			}
+		}
+
+		unmatched, err := store.Reindex(cctx.Context, deals, provider)
+		if err != nil {
+			return err
+		}
+		sectors := make([]uint64, 0, len(unmatched))
+		for n := range unmatched {
+			sectors = append(sectors, n)
+		}
+		sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+		for _, n := range sectors {
+			fmt.Printf("sector %d: %s\n", n, unmatched[n])
+		}
+		fmt.Printf("reindexed %d sectors, %d unmatched\n", len(store.i.Metadata), len(unmatched))
+		return nil
+	},
+}
+
+// Reindex replaces the index with one rebuilt from the sector files in the
+// store. Sectors with a sidecar keep the deal recorded there; the rest are
+// matched by CommP to a deal with the given provider and have a sidecar written.
+// Sectors that can't be matched are returned along with the reason.
+// Quarantined sectors stay quarantined.
+func (f *filestore) Reindex(ctx context.Context, deals map[string]*api.MarketDeal, provider address.Address) (map[uint64]string, error) {
+	byPiece := make(map[cid.Cid][]abi.DealID)
+	for id, d := range deals {
+		if d.Proposal.Provider != provider {
+			continue
+		}
+		dealID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deal id %q: %w", id, err)
+		}
+		byPiece[d.Proposal.PieceCID] = append(byPiece[d.Proposal.PieceCID], abi.DealID(dealID))
+	}
+	for _, ids := range byPiece {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+	sectors := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		var n uint64
+		if _, err := fmt.Sscanf(e.Name(), "%d.sector", &n); err != nil || e.Name() != fmt.Sprintf("%d.sector", n) {
+			continue
+		}
+		sectors = append(sectors, n)
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+
+	i := index{N: 0, Metadata: make(map[uint64]api.PieceDealInfo), Quarantine: f.snapshot().Quarantine}
+	unmatched := make(map[uint64]string)
+	claimed := make(map[abi.DealID]struct{})
+	scanned := make(map[uint64]*sectorMeta)
+	for _, n := range sectors {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if n >= i.N {
+			i.N = n + 1
+		}
+		if _, ok := i.Quarantine[n]; ok {
+			continue
+		}
+
+		if sm, err := f.readSidecar(n); err == nil {
+			i.Metadata[n] = sm.DealInfo
+			claimed[sm.DealInfo.DealID] = struct{}{}
+			continue
+		}
+
+		sr, err := f.openSector(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		size := abi.UnpaddedPieceSize(sr.Size())
+		if err := size.Validate(); err != nil {
+			unmatched[n] = fmt.Sprintf("size %d is not a valid piece size", sr.Size())
+			sr.Close()
+			continue
+		}
+		h := sha256.New()
+		c, err := pieceCID(io.TeeReader(io.NewSectionReader(sr, 0, sr.Size()), h), size.Padded())
+		sr.Close()
+		if err != nil {
+			unmatched[n] = fmt.Sprintf("computing commp: %s", err)
+			continue
+		}
+		sm := &sectorMeta{Size: sr.Size(), CommP: &c, SHA256: hex.EncodeToString(h.Sum(nil))}
+		if _, ok := sr.(*encodedSector); ok {
+			sm.Encoding = encodingZstdSeekable
+		}
+		scanned[n] = sm
+	}
+
+	// sectors with sidecars are matched first, so their deals aren't reassigned.
+	for _, n := range sectors {
+		sm, ok := scanned[n]
+		if !ok {
+			continue
+		}
+		c := *sm.CommP
+		var dealID abi.DealID
+		found := false
+		for len(byPiece[c]) > 0 && !found {
+			dealID, byPiece[c] = byPiece[c][0], byPiece[c][1:]
+			_, taken := claimed[dealID]
+			found = !taken
+		}
+		if !found {
+			unmatched[n] = fmt.Sprintf("no deal found for piece %s", c)
+			continue
+		}
+
+		prop := deals[strconv.FormatUint(uint64(dealID), 10)].Proposal
+		i.Metadata[n] = api.PieceDealInfo{
+			DealID:       dealID,
+			DealProposal: &prop,
+			DealSchedule: api.DealSchedule{
+				StartEpoch: prop.StartEpoch,
+				EndEpoch:   prop.EndEpoch,
+			},
+			KeepUnsealed: true,
+		}
+		stat, err := os.Stat(f.sectorPath(n))
+		if err != nil {
+			return nil, err
+		}
+		sm.DealInfo = i.Metadata[n]
+		sm.Ingested = stat.ModTime()
+		if sm.Encoding != "" {
+			sm.Stored = stat.Size()
+		}
+		if err := f.writeSidecar(n, sm); err != nil {
+			return nil, err
+		}
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+	// never hand out a sector number again, even if its file is gone.
+	if f.i.N > i.N {
+		i.N = f.i.N
+	}
+	f.i = i
+	return unmatched, f.saveIndex(ctx)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+)
+
+func TestReindexFromSidecars(t *testing.T) {
+	f, s := newFilledStore(t, nil, 1, 2)
+	loseIndex(f)
+
+	unmatched, err := f.Reindex(context.Background(), nil, syntheticAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSectors(t, "unmatched", keys(unmatched), nil)
+	assertDeals(t, f, map[uint64]abi.DealID{s[0]: 1, s[1]: 2})
+}
+
+func TestReindexMatchesDealsByCommP(t *testing.T) {
+	other, _ := address.NewIDAddress(1000)
+	// sectors 0 and 2 hold the same piece.
+	f, s := newFilledStore(t, nil, 1, 2, 1)
+	for _, n := range s {
+		os.Remove(f.metaPath(n))
+	}
+	loseIndex(f)
+
+	deals := map[string]*api.MarketDeal{
+		"10": testDeal(t, 1, syntheticAddress),
+		"11": testDeal(t, 2, other),
+	}
+	unmatched, err := f.Reindex(context.Background(), deals, syntheticAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deals with other providers aren't matched, and a deal is only matched once.
+	assertSectors(t, "unmatched", keys(unmatched), s[1:])
+	assertDeals(t, f, map[uint64]abi.DealID{s[0]: 10})
+	if f.i.N != uint64(len(s)) {
+		t.Errorf("N = %d, want %d", f.i.N, len(s))
+	}
+}
+
+func TestReindexKeepsQuarantine(t *testing.T) {
+	f, s := newFilledStore(t, nil, 1, 2)
+	if err := f.Quarantine(context.Background(), s[1], "bad"); err != nil {
+		t.Fatal(err)
+	}
+	loseIndex(f)
+
+	if _, err := f.Reindex(context.Background(), nil, syntheticAddress); err != nil {
+		t.Fatal(err)
+	}
+	assertDeals(t, f, map[uint64]abi.DealID{s[0]: 1})
+	if _, ok := f.i.Quarantine[s[1]]; !ok || len(f.i.Quarantine) != 1 {
+		t.Fatalf("quarantined sectors %v, want %d", f.i.Quarantine, s[1])
+	}
+}
+
+// loseIndex drops the deals of every sector from the index.
+func loseIndex(f *filestore) {
+	f.i.Metadata = make(map[uint64]api.PieceDealInfo)
+}
+
+// assertDeals checks the index has exactly the deals of each sector in want.
+func assertDeals(t *testing.T, f *filestore, want map[uint64]abi.DealID) {
+	t.Helper()
+	if len(f.i.Metadata) != len(want) {
+		t.Errorf("reindexed %d sectors, want %d", len(f.i.Metadata), len(want))
+	}
+	for n, id := range want {
+		if md, ok := f.i.Metadata[n]; !ok || md.DealID != id {
+			t.Errorf("sector %d has deal %d, want %d", n, md.DealID, id)
+		}
+	}
+}
+
+// testDeal returns a deal with provider for the piece testPiece derives from seed.
+func testDeal(t *testing.T, seed int64, provider address.Address) *api.MarketDeal {
+	_, md := testPiece(t, seed)
+	prop := *md.DealProposal
+	prop.Provider = provider
+	return &api.MarketDeal{Proposal: prop}
+}
@@ -7,8 +7,8 @@ import (
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	stbig "github.com/filecoin-project/go-state-types/big"
-	"github.com/filecoin-project/go-state-types/builtin/v8/miner"
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/builtin/v9/miner"
 	"github.com/filecoin-project/lotus/api"
 	cminer "github.com/filecoin-project/lotus/chain/actors/builtin/miner"
 	"github.com/filecoin-project/lotus/chain/types"
@@ -17,7 +17,7 @@ import (
 )
 
 func (sh *StorageHandler) SectorAddPieceToAny(ctx context.Context, size abi.UnpaddedPieceSize, r storiface.Data, d api.PieceDealInfo) (api.SectorOffset, error) {
-	id, err := sh.storage.Add(r, d)
+	id, err := sh.storage.Add(ctx, r, d)
 	if err != nil {
 		return api.SectorOffset{
 			Sector: abi.SectorNumber(id),
@@ -48,7 +48,7 @@ func (sh *StorageHandler) SectorsStatus(ctx context.Context, sid abi.SectorNumbe
 	defer sh.storage.l.RUnlock()
 
 	md := sh.storage.GetMeta(uint64(sid))
-	if sh.storage.i.N > uint64(sid) {
+	if md != nil {
 		dpc, _ := md.DealProposal.Cid()
 		zero := stbig.NewInt(0)
 
@@ -139,12 +139,10 @@ func (sh *StorageHandler) StateSectorGetInfo(ctx context.Context, maddr address.
 }
 
 func (sh *StorageHandler) StorageFindSector(ctx context.Context, sector abi.SectorID, ft storiface.SectorFileType, ssize abi.SectorSize, allowFetch bool) ([]storiface.SectorStorageInfo, error) {
-	myAddr := sh.listener.Addr()
-
 	return []storiface.SectorStorageInfo{
 		{
 			ID:       storiface.ID(fmt.Sprintf("sector-%d", sector.Number)),
-			URLs:     []string{fmt.Sprintf("http://%s/sector/%d", myAddr.String(), sector.Number)},
+			URLs:     []string{fmt.Sprintf("%s/sector%s/%d", sh.retrievalURL, sh.prefix, sector.Number)},
 			BaseURLs: []string{},
 			Weight:   0,
 			CanSeal:  false,
@@ -162,6 +160,11 @@ func (sh *StorageHandler) StateMarketStorageDeal(ctx context.Context, dealId abi
 		Proposal: market.DealProposal{},
 		State:    market.DealState{},
 	}
+	if sh.market != nil {
+		if d, err := sh.market.deal(dealId); err == nil {
+			md = d
+		}
+	}
 
 	for _, di := range sh.storage.i.Metadata {
 		if di.DealID == dealId {
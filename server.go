@@ -2,38 +2,50 @@ package main
 
 import (
 	"context"
-	"errors"
-	"log"
-	"net"
+	"crypto/tls"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-jsonrpc"
 	"github.com/filecoin-project/go-state-types/abi"
+	actorstypes "github.com/filecoin-project/go-state-types/actors"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
 	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/manifest"
 	"github.com/filecoin-project/lotus/api"
 	lotusclient "github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/actors"
 	"github.com/filecoin-project/lotus/chain/types"
 	lotuscliutil "github.com/filecoin-project/lotus/cli/util"
-	"github.com/filecoin-project/lotus/lib/rpcenc"
 	"github.com/filecoin-project/lotus/storage/sealer/storiface"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	"github.com/urfave/cli/v2"
 )
 
-var syntheticAddress, _ = address.NewIDAddress(88)
-
 type StorageHandler struct {
-	api      api.FullNode
-	wallet   api.Wallet
-	isMiner  bool
-	listener net.Listener
+	api     api.FullNode
+	wallet  api.Wallet
+	isMiner bool
+	// retrievalURL is the base of the URLs sector data is fetched from.
+	retrievalURL string
 
 	storage *filestore
+	pool    messagePool
+	// market simulates the market actor when messages aren't sent upstream.
+	market *marketSim
+	miner  *minerIdentity
+	// prefix namespaces the paths of miners other than the primary.
+	prefix string
+	policy *signingPolicy
 }
 
 func (sh *StorageHandler) Version(ctx context.Context) (api.APIVersion, error) {
@@ -48,7 +60,7 @@ func (sh *StorageHandler) Version(ctx context.Context) (api.APIVersion, error) {
 }
 
 func (sh *StorageHandler) ActorAddress(ctx context.Context) (address.Address, error) {
-	return syntheticAddress, nil
+	return sh.miner.Actor, nil
 }
 
 func (sh *StorageHandler) SyncState(ctx context.Context) (*api.SyncState, error) {
@@ -78,11 +90,10 @@ func (sh *StorageHandler) ChainHead(ctx context.Context) (*types.TipSet, error)
 }
 
 func (sh *StorageHandler) StateMarketBalance(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MarketBalance, error) {
-	zero := big.NewInt(0)
-	return api.MarketBalance{
-		Escrow: zero,
-		Locked: zero,
-	}, nil
+	if sh.market == nil {
+		return sh.api.StateMarketBalance(ctx, addr, tsk)
+	}
+	return sh.market.marketBalance(ctx, addr), nil
 }
 
 func (sh *StorageHandler) StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
@@ -97,20 +108,45 @@ func (sh *StorageHandler) StateDealProviderCollateralBounds(ctx context.Context,
 }
 
 func (sh *StorageHandler) MpoolPending(ctx context.Context, tsk types.TipSetKey) ([]*types.SignedMessage, error) {
-	return []*types.SignedMessage{}, nil
+	return sh.pool.pending(ctx, tsk)
 }
 
 func (sh *StorageHandler) StateMinerInfo(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
-	if addr == syntheticAddress || addr.Empty() {
-		return api.MinerInfo{
-			Worker: syntheticAddress,
-		}, nil
+	if addr == sh.miner.Actor || addr.Empty() {
+		return sh.miner.info(ctx, sh.api)
 	}
 	return sh.api.StateMinerInfo(ctx, addr, tsk)
 }
 
 func (sh *StorageHandler) StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error) {
-	return nil, nil
+	if sh.market == nil {
+		return sh.api.StateGetActor(ctx, actor, tsk)
+	}
+	switch actor {
+	case builtin.StorageMarketActorAddr:
+		return simulatedActor(manifest.MarketKey, sh.market.totalEscrow())
+	case sh.miner.Actor:
+		return simulatedActor(manifest.MinerKey, sh.market.accountBalance(ctx, actor))
+	}
+	if local, err := sh.isLocal(ctx, actor); err != nil {
+		return nil, err
+	} else if local {
+		return simulatedActor(manifest.AccountKey, sh.market.accountBalance(ctx, actor))
+	}
+	return sh.api.StateGetActor(ctx, actor, tsk)
+}
+
+// simulatedActor describes a builtin actor whose state is simulated locally.
+func simulatedActor(name string, balance abi.TokenAmount) (*types.Actor, error) {
+	code, ok := actors.GetActorCodeID(actorstypes.Version9, name)
+	if !ok {
+		return nil, fmt.Errorf("no code for %s actor", name)
+	}
+	return &types.Actor{
+		Code:    code,
+		Head:    mockCid,
+		Balance: balance,
+	}, nil
 }
 
 func (sh *StorageHandler) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
@@ -118,32 +154,40 @@ func (sh *StorageHandler) StateLookupID(ctx context.Context, addr address.Addres
 }
 
 func (sh *StorageHandler) StateCall(ctx context.Context, msg *types.Message, tsk types.TipSetKey) (*api.InvocResult, error) {
-	return &api.InvocResult{
-		MsgCid: msg.Cid(),
-		Msg:    msg,
-		MsgRct: &types.MessageReceipt{
-			ExitCode: exitcode.Ok,
-		},
+	if sh.market == nil {
+		return sh.api.StateCall(ctx, msg, tsk)
+	}
+	ts, err := sh.api.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+	rct := sh.market.call(ctx, msg, ts.Height())
+	res := &api.InvocResult{
+		MsgCid:  msg.Cid(),
+		Msg:     msg,
+		MsgRct:  &rct,
 		GasCost: api.MsgGasCost{Message: msg.Cid(), GasUsed: abi.NewTokenAmount(0), TotalCost: abi.NewTokenAmount(0)},
-	}, nil
+	}
+	if rct.ExitCode != exitcode.Ok {
+		res.Error = fmt.Sprintf("simulated market actor exited with %s", rct.ExitCode)
+	}
+	return res, nil
 }
 
-func (sh *StorageHandler) StateWaitMsg(ctx context.Context, msg cid.Cid, confidence uint64) (*api.MsgLookup, error) {
-	ml := &api.MsgLookup{
-		Message: msg,
-		Receipt: types.MessageReceipt{
-			ExitCode: exitcode.Ok,
-		},
-	}
-	return ml, nil
+func (sh *StorageHandler) StateWaitMsg(ctx context.Context, msg cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	return sh.pool.wait(ctx, msg, confidence)
 }
 
 func (sh *StorageHandler) MpoolPushMessage(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec) (*types.SignedMessage, error) {
+	return sh.pool.push(ctx, msg, spec, sh.signMessage)
+}
+
+func (sh *StorageHandler) signMessage(ctx context.Context, msg *types.Message) (*types.SignedMessage, error) {
 	mb, err := msg.ToStorageBlock()
 	if err != nil {
 		return nil, err
 	}
-	sig, err := sh.wallet.WalletSign(ctx, msg.From, mb.Cid().Bytes(), api.MsgMeta{
+	sig, err := sh.sign(ctx, msg.From, mb.Cid().Bytes(), api.MsgMeta{
 		Type:  api.MTChainMsg,
 		Extra: mb.RawData(),
 	})
@@ -171,7 +215,17 @@ func (sh *StorageHandler) WalletList(ctx context.Context) ([]address.Address, er
 	return sh.wallet.WalletList(ctx)
 }
 
-func (sh *StorageHandler) WalletSign(ctx context.Context, signer address.Address, toSign []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+// WalletSign signs arbitrary data, as the lotus full node does. Callers don't
+// say what the data is, so the signing policy checks it as the type it decodes as.
+func (sh *StorageHandler) WalletSign(ctx context.Context, signer address.Address, toSign []byte) (*crypto.Signature, error) {
+	return sh.sign(ctx, signer, toSign, api.MsgMeta{Type: signingType(toSign)})
+}
+
+// sign signs toSign, described by meta, if the signing policy allows it.
+func (sh *StorageHandler) sign(ctx context.Context, signer address.Address, toSign []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	if err := sh.policy.check(ctx, signer, toSign, meta); err != nil {
+		return nil, err
+	}
 	return sh.wallet.WalletSign(ctx, signer, toSign, meta)
 }
 
@@ -186,33 +240,28 @@ func (sh *StorageHandler) WalletDelete(ctx context.Context, a address.Address) e
 }
 
 func Serve(ctx *cli.Context) error {
-	store, err := NewStore(ctx.String("root"))
+	store, err := openStore(ctx)
 	if err != nil {
 		return err
 	}
-	readerHandler, readerServerOpt := rpcenc.ReaderParamDecoder()
-	fullServer := jsonrpc.NewServer(readerServerOpt)
-	minerServer := jsonrpc.NewServer(readerServerOpt)
-
-	ainfo := lotuscliutil.ParseApiInfo(ctx.String("api"))
-	addr, err := ainfo.DialArgs("v1")
-	if err != nil {
-		return err
+	if ctx.Bool("encrypt") && store.key == nil {
+		return fmt.Errorf("--encrypt requires a master key from --master-key-file or %s", masterKeyEnv)
 	}
-	lapi, closer, err := lotusclient.NewFullNodeRPCV1(ctx.Context, addr, nil)
+	streams := newReaderStreams()
+
+	lapi, closer, err := dialFullNode(ctx)
 	if err != nil {
 		return err
 	}
 	defer closer()
+	lapi = timedFullNode(lapi)
 	var wallet api.Wallet
 	if ctx.String("wallet") == "internal" {
-		_, err := os.Stat(".wallet")
-		if errors.Is(err, os.ErrNotExist) {
-			makeWallet(".wallet")
-		} else if err != nil {
+		passphrase, err := loadPassphrase(ctx.String("keystore-passphrase-file"), ctx.Bool("keystore-insecure"))
+		if err != nil {
 			return err
 		}
-		wapi, err := loadWallet(".wallet")
+		wapi, err := openInternalWallet(ctx.Context, store.root, passphrase)
 		if err != nil {
 			return err
 		}
@@ -230,33 +279,202 @@ func Serve(ctx *cli.Context) error {
 		defer closer()
 		wallet = wapi
 	}
-	fullHandler := &StorageHandler{lapi, wallet, false, nil, store}
-	minerHandler := &StorageHandler{lapi, wallet, true, nil, store}
+	var pool messagePool
+	var market *marketSim
+	switch ctx.String("mpool") {
+	case "synthetic":
+		balance, err := types.ParseFIL(ctx.String("sim-balance"))
+		if err != nil {
+			return fmt.Errorf("--sim-balance: %w", err)
+		}
+		lp, err := openLocalPool(ctx.Context, lapi, path.Join(store.root, "messages"), abi.TokenAmount(balance))
+		if err != nil {
+			return err
+		}
+		pool, market = lp, lp.market
+	case "live":
+		if ctx.String("api") == "mock" {
+			return fmt.Errorf("--mpool=live needs a real upstream node")
+		}
+		pool = newLivePool(lapi)
+	default:
+		return fmt.Errorf("unknown --mpool mode %q", ctx.String("mpool"))
+	}
+	identity, err := loadIdentity(ctx, store.root, wallet)
+	if err != nil {
+		return err
+	}
+	extra, err := openExtraMiners(ctx, store.root, identity, wallet)
+	if err != nil {
+		return err
+	}
+	miners := append([]*hostedMiner{{identity, store, ""}}, extra...)
+	var policy *signingPolicy
+	if ctx.IsSet("signing-policy") {
+		if policy, err = loadSigningPolicy(ctx.String("signing-policy"), path.Join(store.root, "signing-audit")); err != nil {
+			return err
+		}
+	}
 
-	fullServer.Register("Filecoin", fullHandler)
-	minerServer.Register("Filecoin", minerHandler)
+	secret, err := loadSecret(store.root)
+	if err != nil {
+		return err
+	}
 
-	server := http.Server{}
-	mux := http.NewServeMux()
-	mux.Handle("/rpc/v1", fullServer)
-	mux.Handle("/rpc/v0", minerServer)
-	mux.Handle("/rpc/streams/v0/push/", readerHandler)
-	mux.Handle("/sector/", store.retrieveHandler())
-	server.Handler = logRequest(mux)
+	var tlsConf *tls.Config
+	if tlsEnabled(ctx) {
+		if tlsConf, err = loadTLSConfig(ctx, store.root); err != nil {
+			return err
+		}
+	} else if ctx.IsSet("tls-client-ca") {
+		return fmt.Errorf("--tls-client-ca needs --tls-cert or --tls-self-signed")
+	}
 
-	listenStr := ctx.String("listen")
-	listener, err := net.Listen("tcp", listenStr)
+	if _, unix := unixSocketPath(retrievalAddr(ctx)); unix {
+		return fmt.Errorf("sector data must be served over TCP, set --retrieval-listen to a [host]:port")
+	}
+	mode, err := socketMode(ctx)
 	if err != nil {
 		return err
 	}
-	fullHandler.listener = listener
-	minerHandler.listener = listener
-	return server.Serve(listener)
-}
 
-func logRequest(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-		handler.ServeHTTP(w, r)
+	// stop serving on the first signal. A second one exits immediately.
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	eps := newEndpoints()
+	rpcMux := eps.at(ctx.String("listen"))
+	retrievalMux := eps.at(retrievalAddr(ctx))
+	stores := make([]*filestore, 0, len(miners))
+	for _, m := range miners {
+		stores = append(stores, m.store)
+	}
+	// metrics reveal the store's layout and use, so they need a token on the RPC listener.
+	if ctx.IsSet("admin-listen") {
+		adminMux := eps.at(ctx.String("admin-listen"))
+		handleAdmin(adminMux)
+		adminMux.Handle("/metrics", metricsHandler(stores))
+	} else {
+		rpcMux.Handle("/metrics", requirePerm(api.PermRead, metricsHandler(stores)))
+	}
+	retrievalURL := publicURL(ctx)
+
+	rpcMux.Handle("/rpc/streams/v0/push/", streams.withCallerPerms(requirePerm(api.PermWrite, streams)))
+	for _, m := range miners {
+		m.store.compress = ctx.Bool("compress")
+		m.store.encrypt = ctx.Bool("encrypt")
+		if interval := ctx.Duration("scrub-interval"); interval > 0 {
+			if err := m.store.checkKey(); err != nil {
+				return fmt.Errorf("--scrub-interval: miner %s: %w", m.identity.Actor, err)
+			}
+			go m.store.scrub(sigCtx, interval, ctx.Bool("scrub-quarantine"))
+		}
+
+		fullServer := jsonrpc.NewServer(streams.serverOption())
+		minerServer := jsonrpc.NewServer(streams.serverOption())
+		fullHandler := &StorageHandler{lapi, wallet, false, retrievalURL, m.store, pool, market, m.identity, m.prefix, policy}
+		minerHandler := &StorageHandler{lapi, wallet, true, retrievalURL, m.store, pool, market, m.identity, m.prefix, policy}
+
+		fullImpls := []interface{}{fullHandler}
+		if ctx.Bool("fallback") {
+			policy := newFallbackPolicy(ctx.StringSlice("fallback-allow"), ctx.StringSlice("fallback-deny"))
+			fullImpls = append(fullImpls, fallbackProxy(fullHandler, lapi, policy))
+		}
+		// both endpoints serve the methods of both APIs, with those of the
+		// endpoint's own API registered last so they win where the two overlap.
+		for _, reg := range []struct {
+			server *jsonrpc.RPCServer
+			apis   []interface{}
+			impls  []interface{}
+		}{
+			{fullServer, []interface{}{&api.StorageMinerStruct{}, &api.FullNodeStruct{}}, fullImpls},
+			{minerServer, []interface{}{&api.FullNodeStruct{}, &api.StorageMinerStruct{}}, []interface{}{minerHandler}},
+		} {
+			for _, out := range reg.apis {
+				if err := permissioned(out, reg.impls...); err != nil {
+					return err
+				}
+				reg.server.Register("Filecoin", out)
+			}
+		}
+
+		rpcMux.Handle("/rpc/v1"+m.prefix, fullServer)
+		rpcMux.Handle("/rpc/v0"+m.prefix, minerServer)
+		retrievalMux.Handle("/sector"+m.prefix+"/", sectorAuth(secret, m.store.retrieveHandler("/sector"+m.prefix)))
+	}
+
+	err = eps.serve(sigCtx, tlsConf, mode, func(h http.Handler) http.Handler {
+		return logRequest(authHandler(secret, h))
 	})
+	if err != nil {
+		return err
+	}
+	stop()
+	return shutdown(eps, miners, ctx.Duration("shutdown-timeout"))
+}
+
+// shutdown stops taking new pieces, waits up to timeout for the uploads and
+// downloads in progress, and writes out each store's index.
+func shutdown(eps *endpoints, miners []*hostedMiner, timeout time.Duration) error {
+	serverLog.Infow("shutting down, waiting for uploads and downloads to finish", "timeout", timeout)
+	for _, m := range miners {
+		m.store.close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := eps.shutdown(ctx); err != nil {
+		serverLog.Warnw("closing connections", "error", err)
+	}
+
+	var ferr error
+	for _, m := range miners {
+		writing, reading := m.store.drain(ctx)
+		if len(writing) > 0 {
+			serverLog.Warnw("interrupted uploads", "miner", m.identity.Actor, "sectors", writing)
+		}
+		if reading > 0 {
+			serverLog.Warnw("interrupted downloads", "miner", m.identity.Actor, "count", reading)
+		}
+		if err := m.store.flush(ctx); err != nil && ferr == nil {
+			ferr = fmt.Errorf("writing index of miner %s: %w", m.identity.Actor, err)
+		}
+	}
+	if ferr == nil {
+		serverLog.Info("shut down")
+	}
+	return ferr
+}
+
+// openStore opens the store at --root, with the master key used to encrypt piece data if one is configured.
+func openStore(ctx *cli.Context) (*filestore, error) {
+	return openStoreAt(ctx, ctx.String("root"))
+}
+
+func openStoreAt(ctx *cli.Context, root string) (*filestore, error) {
+	store, err := NewStore(root)
+	if err != nil {
+		return nil, err
+	}
+	if store.key, err = loadMasterKey(ctx.String("master-key-file")); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// dialFullNode connects to the backing chain API given by --api, or starts a
+// simulated chain if it is "mock".
+func dialFullNode(ctx *cli.Context) (api.FullNode, jsonrpc.ClientCloser, error) {
+	if ctx.String("api") == "mock" {
+		mc, closer, err := newMockChain(ctx.Context, ctx.Duration("mock-block-time"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return mc, closer, nil
+	}
+	ainfo := lotuscliutil.ParseApiInfo(ctx.String("api"))
+	addr, err := ainfo.DialArgs("v1")
+	if err != nil {
+		return nil, nil, err
+	}
+	return lotusclient.NewFullNodeRPCV1(ctx.Context, addr, nil)
 }
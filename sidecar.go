@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+)
+
+// sectorMeta is the sidecar stored next to each sector's data as N.meta, so a
+// piece file can be understood on its own and the index can be rebuilt from them.
+type sectorMeta struct {
+	DealInfo api.PieceDealInfo
+	Size     int64
+	CommP    *cid.Cid `json:",omitempty"`
+	SHA256   string
+	Ingested time.Time
+
+	// Encoding of the data file when it isn't the raw piece, and its size on disk.
+	Encoding   string     `json:",omitempty"`
+	Encryption *sectorKey `json:",omitempty"`
+	Stored     int64      `json:",omitempty"`
+}
+
+func (sm *sectorMeta) StoredSize() int64 {
+	if sm.Stored == 0 {
+		return sm.Size
+	}
+	return sm.Stored
+}
+
+func (f *filestore) metaPath(n uint64) string {
+	return path.Join(f.root, fmt.Sprintf("%d.meta", n))
+}
+
+// writeSector streams r into the data file for sector n, computing checksums along the way.
+// Data is written to a temporary file and only renamed into place once complete.
+func (f *filestore) writeSector(n uint64, r io.Reader, md api.PieceDealInfo) (*sectorMeta, error) {
+	tmp := f.sectorPath(n) + ".part"
+	fi, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	// pieces are compressed before they are encrypted.
+	var w io.WriteCloser = fi
+	var key *sectorKey
+	if f.encrypt {
+		ew, sk, err := newEncryptingWriter(fi, f.key)
+		if err != nil {
+			fi.Close()
+			return nil, err
+		}
+		w = &stackedWriteCloser{ew, fi}
+		key = sk
+	}
+	encoding := ""
+	if f.compress {
+		w = &stackedWriteCloser{newSeekableWriter(w), w}
+		encoding = encodingZstdSeekable
+	}
+
+	h := sha256.New()
+	cp := &commp.Calc{}
+	size, err := io.Copy(io.MultiWriter(w, h, cp), r)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, f.sectorPath(n)); err != nil {
+		return nil, err
+	}
+
+	sm := &sectorMeta{
+		DealInfo:   md,
+		Size:       size,
+		SHA256:     hex.EncodeToString(h.Sum(nil)),
+		Ingested:   time.Now(),
+		Encoding:   encoding,
+		Encryption: key,
+	}
+	if encoding != "" || key != nil {
+		sm.Stored = stat.Size()
+	}
+	if md.DealProposal != nil {
+		if c, err := digestCID(cp, md.DealProposal.PieceSize); err == nil {
+			sm.CommP = &c
+		}
+	}
+	return sm, nil
+}
+
+// writeSidecar atomically replaces the sidecar for sector n.
+func (f *filestore) writeSidecar(n uint64, sm *sectorMeta) error {
+	return writeSidecarFile(f.metaPath(n), sm)
+}
+
+func writeSidecarFile(p string, sm *sectorMeta) error {
+	b, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// stackedWriteCloser closes an encoding writer before the writer beneath it.
+type stackedWriteCloser struct {
+	io.WriteCloser
+	under io.Closer
+}
+
+func (s *stackedWriteCloser) Close() error {
+	err := s.WriteCloser.Close()
+	if cerr := s.under.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *filestore) readSidecar(n uint64) (*sectorMeta, error) {
+	return readSidecarFile(f.metaPath(n))
+}
+
+func readSidecarFile(p string) (*sectorMeta, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	sm := &sectorMeta{}
+	if err := json.Unmarshal(b, sm); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// loadSidecars populates the index from the sidecars in the store root.
+// The caller must hold the write lock, or own the store exclusively.
+func (f *filestore) loadSidecars() error {
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var n uint64
+		if _, err := fmt.Sscanf(e.Name(), "%d.sector", &n); err == nil && e.Name() == fmt.Sprintf("%d.sector", n) {
+			// piece files without a sidecar still hold their sector number.
+			if n >= f.i.N {
+				f.i.N = n + 1
+			}
+			continue
+		}
+		if _, err := fmt.Sscanf(e.Name(), "%d.meta", &n); err != nil || e.Name() != fmt.Sprintf("%d.meta", n) {
+			continue
+		}
+		sm, err := f.readSidecar(n)
+		if err != nil {
+			return fmt.Errorf("reading sidecar for sector %d: %w", n, err)
+		}
+		f.i.Metadata[n] = sm.DealInfo
+		if n >= f.i.N {
+			f.i.N = n + 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/lib/httpreader"
+	"github.com/filecoin-project/lotus/lib/rpcenc"
+	"github.com/filecoin-project/lotus/storage/pipeline/lib/nullreader"
+	"github.com/google/uuid"
+)
+
+// readerStreams pairs the io.Reader parameters of RPC calls with the data lotus
+// clients push for them to /rpc/streams/v0/push/<uuid>, in place of lotus'
+// rpcenc.ReaderParamDecoder. lotus clients don't send their token with pushes,
+// so a push is made with the permissions of the call taking its stream.
+type readerStreams struct {
+	l       sync.Mutex
+	streams map[uuid.UUID]*readerStream
+}
+
+// readerStream is a pushed reader parameter, read by the call taking it.
+type readerStream struct {
+	id     uuid.UUID
+	owner  *readerStreams
+	pushed bool
+
+	// perms are those of the call taking the stream, set before claimed is closed.
+	perms   []auth.Permission
+	claimed chan struct{}
+	// started is closed on the first read, asking the client to send the data.
+	started   chan struct{}
+	startOnce sync.Once
+	// bodies hands the pushed data to the reader.
+	bodies chan io.Reader
+	// done is closed once the reader is finished with the data.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	body io.Reader
+	err  error
+}
+
+func newReaderStreams() *readerStreams {
+	return &readerStreams{streams: make(map[uuid.UUID]*readerStream)}
+}
+
+// stream returns the stream id, creating it if it isn't known yet. The caller must hold the lock.
+func (rs *readerStreams) stream(id uuid.UUID) *readerStream {
+	s, ok := rs.streams[id]
+	if !ok {
+		s = &readerStream{
+			id:      id,
+			owner:   rs,
+			claimed: make(chan struct{}),
+			started: make(chan struct{}),
+			bodies:  make(chan io.Reader),
+			done:    make(chan struct{}),
+		}
+		rs.streams[id] = s
+	}
+	return s
+}
+
+// serverOption decodes reader parameters, as the one from rpcenc.ReaderParamDecoder does.
+func (rs *readerStreams) serverOption() jsonrpc.ServerOption {
+	return jsonrpc.WithParamDecoder(new(io.Reader), func(ctx context.Context, b []byte) (reflect.Value, error) {
+		var param rpcenc.ReaderStream
+		if err := json.Unmarshal(b, &param); err != nil {
+			return reflect.Value{}, fmt.Errorf("unmarshaling reader stream: %w", err)
+		}
+		switch param.Type {
+		case rpcenc.Null:
+			n, err := strconv.ParseInt(param.Info, 10, 64)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("parsing null byte count: %w", err)
+			}
+			return reflect.ValueOf(nullreader.NewNullReader(abi.UnpaddedPieceSize(n))), nil
+		case rpcenc.HTTP:
+			return reflect.ValueOf(&httpreader.HttpReader{URL: param.Info}), nil
+		case rpcenc.PushStream:
+		default:
+			return reflect.Value{}, fmt.Errorf("unknown reader stream type %q", param.Type)
+		}
+		id, err := uuid.Parse(param.Info)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("parsing reader stream id: %w", err)
+		}
+
+		rs.l.Lock()
+		defer rs.l.Unlock()
+		s := rs.stream(id)
+		select {
+		case <-s.claimed:
+			return reflect.Value{}, fmt.Errorf("reader stream %s is already taken", id)
+		default:
+		}
+		s.perms = callerPerms(ctx)
+		close(s.claimed)
+		// drop streams nothing is pushed for, e.g. as the call was denied.
+		time.AfterFunc(rpcenc.Timeout, func() {
+			rs.l.Lock()
+			pushed := s.pushed
+			rs.l.Unlock()
+			if !pushed {
+				s.finish()
+			}
+		})
+		return reflect.ValueOf(s), nil
+	})
+}
+
+// callerPerms lists the permissions of the caller making ctx.
+func callerPerms(ctx context.Context) []auth.Permission {
+	var perms []auth.Permission
+	for _, p := range api.AllPermissions {
+		if auth.HasPerm(ctx, api.DefaultPerms, p) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// withCallerPerms waits for a call to take the stream a push is for, and
+// gives the push that call's permissions. Pushes no call takes are refused.
+func (rs *readerStreams) withCallerPerms(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(path.Base(r.URL.Path))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parsing reader stream id: %s", err), http.StatusBadRequest)
+			return
+		}
+		rs.l.Lock()
+		s := rs.stream(id)
+		s.pushed = true
+		rs.l.Unlock()
+
+		t := time.NewTimer(rpcenc.Timeout)
+		defer t.Stop()
+		select {
+		case <-s.claimed:
+		case <-t.C:
+			s.finish()
+			http.Error(w, "no call takes this reader stream", http.StatusNotFound)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithPerm(r.Context(), s.perms)))
+	})
+}
+
+// ServeHTTP takes the data pushed for a stream. Clients first send a HEAD
+// request, answered once the stream is read from, and then POST the data.
+func (rs *readerStreams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(path.Base(r.URL.Path))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing reader stream id: %s", err), http.StatusBadRequest)
+		return
+	}
+	rs.l.Lock()
+	s, ok := rs.streams[id]
+	rs.l.Unlock()
+	if !ok {
+		http.Error(w, "reader stream is closed", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		select {
+		case <-s.started:
+			w.WriteHeader(http.StatusOK)
+		case <-s.done:
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		}
+	case http.MethodPost:
+		select {
+		case s.bodies <- r.Body:
+		case <-s.done:
+			http.Error(w, "reader stream is closed", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case <-s.done:
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+		}
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *readerStream) Read(p []byte) (int, error) {
+	s.startOnce.Do(func() { close(s.started) })
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.body == nil {
+		// the client pushes the data as soon as its HEAD request is answered,
+		// unless the push was refused.
+		t := time.NewTimer(rpcenc.Timeout)
+		defer t.Stop()
+		select {
+		case s.body = <-s.bodies:
+		case <-s.done:
+			s.err = fmt.Errorf("reader stream %s is closed", s.id)
+			return 0, s.err
+		case <-t.C:
+			s.err = fmt.Errorf("reader stream %s: no data was pushed", s.id)
+			s.finish()
+			return 0, s.err
+		}
+	}
+	n, err := s.body.Read(p)
+	if err != nil {
+		s.err = err
+		s.finish()
+	}
+	return n, err
+}
+
+func (s *readerStream) Close() error {
+	s.finish()
+	return nil
+}
+
+// finish ends the stream, letting the push requests for it return.
+func (s *readerStream) finish() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+		s.owner.l.Lock()
+		delete(s.owner.streams, s.id)
+		s.owner.l.Unlock()
+	})
+}
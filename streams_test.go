@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/lib/rpcenc"
+	"github.com/google/uuid"
+)
+
+// pushImpl reads whatever it is given, whatever the caller's permissions, so
+// only the push endpoint decides whether the data arrives.
+type pushImpl struct{}
+
+func (pushImpl) Push(ctx context.Context, r io.Reader) ([]byte, error) {
+	return io.ReadAll(r)
+}
+
+type pushClient struct {
+	Push func(context.Context, io.Reader) ([]byte, error)
+}
+
+// newStreamServer serves pushImpl with the reader streams of Serve.
+func newStreamServer(t *testing.T, secret []byte) *httptest.Server {
+	t.Helper()
+	streams := newReaderStreams()
+	rpc := jsonrpc.NewServer(streams.serverOption())
+	rpc.Register("Test", pushImpl{})
+	mux := http.NewServeMux()
+	mux.Handle("/rpc/v0", rpc)
+	mux.Handle("/rpc/streams/v0/push/", streams.withCallerPerms(requirePerm(api.PermWrite, streams)))
+	ts := httptest.NewServer(authHandler(secret, mux))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestReaderStreams(t *testing.T) {
+	timeout := rpcenc.Timeout
+	rpcenc.Timeout = time.Second
+	t.Cleanup(func() { rpcenc.Timeout = timeout })
+
+	secret := []byte("secret")
+	ts := newStreamServer(t, secret)
+	data := bytes.Repeat([]byte("piece data"), 10000)
+
+	for _, tc := range []struct {
+		name string
+		perm auth.Permission
+		// whether the pushed data reaches the call.
+		pushed bool
+	}{
+		{"write token", api.PermWrite, true},
+		{"admin token", api.PermAdmin, true},
+		{"read token", api.PermRead, false},
+		{"no token", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			if tc.perm != "" {
+				token, err := createToken(secret, tc.perm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				header.Set("Authorization", "Bearer "+string(token))
+			}
+			var client pushClient
+			closer, err := jsonrpc.NewMergeClient(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/rpc/v0", "Test",
+				[]interface{}{&client}, header, rpcenc.ReaderParamEncoder(ts.URL+"/rpc/streams/v0/push"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer()
+
+			got, err := client.Push(context.Background(), bytes.NewReader(data))
+			if !tc.pushed {
+				if err == nil {
+					t.Fatal("data was pushed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+
+	t.Run("no call", func(t *testing.T) {
+		token, err := createToken(secret, api.PermAdmin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/rpc/streams/v0/push/"+uuid.New().String(), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("push for a stream no call takes got status %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// tlsEnabled reports whether the listener is configured to serve TLS.
+func tlsEnabled(ctx *cli.Context) bool {
+	return ctx.IsSet("tls-cert") || ctx.Bool("tls-self-signed")
+}
+
+// urlScheme is the scheme of the URLs this instance is reached at.
+func urlScheme(ctx *cli.Context) string {
+	if tlsEnabled(ctx) {
+		return "https"
+	}
+	return "http"
+}
+
+// loadTLSConfig builds the listener's TLS configuration from --tls-cert and
+// --tls-key, or a self-signed certificate kept in root. With --tls-client-ca,
+// clients must present a certificate signed by one of those CAs.
+func loadTLSConfig(ctx *cli.Context, root string) (*tls.Config, error) {
+	certFile, keyFile := ctx.String("tls-cert"), ctx.String("tls-key")
+	if certFile == "" {
+		if ctx.IsSet("tls-key") {
+			return nil, fmt.Errorf("--tls-key needs --tls-cert")
+		}
+		certFile, keyFile = path.Join(root, "tls.crt"), path.Join(root, "tls.key")
+		hosts := []string{ctx.String("listen"), retrievalAddr(ctx), ctx.String("admin-listen")}
+		if u, err := url.Parse(ctx.String("public-url")); err == nil && u.Host != "" {
+			hosts = append(hosts, u.Host)
+		}
+		if err := ensureSelfSigned(certFile, keyFile, hosts); err != nil {
+			return nil, err
+		}
+	} else if keyFile == "" {
+		return nil, fmt.Errorf("--tls-cert needs --tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if ctx.IsSet("tls-client-ca") {
+		b, err := os.ReadFile(ctx.String("tls-client-ca"))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("--tls-client-ca: no certificates found in %s", ctx.String("tls-client-ca"))
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// ensureSelfSigned creates a self-signed certificate for localhost and the
+// hosts of addrs, unless there is one already for exactly those hosts.
+func ensureSelfSigned(certFile, keyFile string, addrs []string) error {
+	dnsNames, ips := certHosts(addrs)
+	if b, err := os.ReadFile(certFile); err == nil {
+		if certHasHosts(b, dnsNames, ips) {
+			return nil
+		}
+		serverLog.Infow("the hosts to serve TLS for have changed, replacing the self-signed certificate", "path", certFile)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "dumbfilstore"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return err
+	}
+	serverLog.Infow("created a self-signed TLS certificate", "path", certFile)
+	return nil
+}
+
+// certHosts lists the names and addresses a self-signed certificate is for:
+// localhost and the hosts of addrs.
+func certHosts(addrs []string) ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	for _, addr := range addrs {
+		if _, unix := unixSocketPath(addr); unix {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				ips = append(ips, ip)
+			}
+		} else if host != "" {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+	return dnsNames, ips
+}
+
+// certHasHosts reports whether the PEM encoded certificate is for exactly
+// dnsNames and ips.
+func certHasHosts(b []byte, dnsNames []string, ips []net.IP) bool {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	want := make(map[string]bool)
+	for _, n := range dnsNames {
+		want[n] = true
+	}
+	for _, ip := range ips {
+		want[ip.String()] = true
+	}
+	have := make(map[string]bool)
+	for _, n := range cert.DNSNames {
+		have[n] = true
+	}
+	for _, ip := range cert.IPAddresses {
+		have[ip.String()] = true
+	}
+	if len(have) != len(want) {
+		return false
+	}
+	for h := range want {
+		if !have[h] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := path.Join(dir, "tls.crt"), path.Join(dir, "tls.key")
+	ensure := func(addrs ...string) (*x509.Certificate, []byte) {
+		t.Helper()
+		if err := ensureSelfSigned(certFile, keyFile, addrs); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(b)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, b
+	}
+
+	cert, first := ensure("store.example.com:9091", "10.0.0.1:9092", ":9093")
+	if err := cert.VerifyHostname("store.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same hosts, however they are listened on, keep the certificate.
+	if _, b := ensure("store.example.com:443", "10.0.0.1:9092"); !bytes.Equal(b, first) {
+		t.Fatal("certificate replaced for the same hosts")
+	}
+
+	cert, b := ensure("store.example.com:9091", "other.example.com:9092")
+	if bytes.Equal(b, first) {
+		t.Fatal("certificate kept after the hosts changed")
+	}
+	if err := cert.VerifyHostname("other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("10.0.0.1"); err == nil {
+		t.Fatal("certificate is still for a host no longer listened on")
+	}
+}
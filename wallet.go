@@ -2,35 +2,344 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/lotus/api"
+	lotusclient "github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/chain/types"
-	ctypes "github.com/filecoin-project/lotus/chain/types"
 	"github.com/filecoin-project/lotus/chain/wallet"
-	"github.com/filecoin-project/lotus/chain/wallet/key"
+	lotuscliutil "github.com/filecoin-project/lotus/cli/util"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	"github.com/urfave/cli/v2"
 )
 
-func (sh *StorageHandler) WalletBalance(context.Context, address.Address) (types.BigInt, error) {
-	return types.NewInt(0), nil
+// WalletBalance reports simulated balances for local accounts when messages
+// aren't sent upstream, and asks the upstream node otherwise.
+func (sh *StorageHandler) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	if sh.market != nil {
+		local, err := sh.isLocal(ctx, addr)
+		if err != nil {
+			return types.BigInt{}, err
+		}
+		if local {
+			return sh.market.accountBalance(ctx, addr), nil
+		}
+	}
+	return sh.api.WalletBalance(ctx, addr)
+}
+
+// isLocal is whether addr is a key in the wallet or the miner actor.
+func (sh *StorageHandler) isLocal(ctx context.Context, addr address.Address) (bool, error) {
+	if addr == sh.miner.Actor {
+		return true, nil
+	}
+	if addr.Protocol() == address.ID {
+		// wallet keys are only known by their key address.
+		key, err := sh.api.StateAccountKey(ctx, addr, types.EmptyTSK)
+		if err != nil {
+			return false, nil
+		}
+		addr = key
+	}
+	return sh.wallet.WalletHas(ctx, addr)
+}
+
+// WalletDefaultAddress is the default key of the internal wallet, as `wallet
+// list` shows it, or else the worker address of the miner identity.
+func (sh *StorageHandler) WalletDefaultAddress(ctx context.Context) (address.Address, error) {
+	if lw, ok := sh.wallet.(*wallet.LocalWallet); ok {
+		if a, err := lw.GetDefault(); err == nil {
+			return a, nil
+		}
+	}
+	return sh.miner.Worker, nil
+}
+
+// WalletSetDefault sets the default key of the internal wallet, which new miner identities use as their worker.
+func (sh *StorageHandler) WalletSetDefault(ctx context.Context, a address.Address) error {
+	lw, ok := sh.wallet.(*wallet.LocalWallet)
+	if !ok {
+		return fmt.Errorf("setting the default address needs --wallet=internal")
+	}
+	return lw.SetDefault(a)
+}
+
+// walletClient is what the wallet commands use, either the local keystore or a running instance.
+type walletClient interface {
+	api.Wallet
+	WalletSetDefault(context.Context, address.Address) error
+	defaultAddress(context.Context) (address.Address, error)
+}
+
+type localWalletClient struct {
+	*wallet.LocalWallet
+}
+
+func (l localWalletClient) WalletSetDefault(ctx context.Context, a address.Address) error {
+	return l.SetDefault(a)
+}
+
+func (l localWalletClient) defaultAddress(ctx context.Context) (address.Address, error) {
+	return l.GetDefault()
+}
+
+type remoteWalletClient struct {
+	api.Wallet
+	full api.FullNode
+}
+
+func (r remoteWalletClient) WalletSetDefault(ctx context.Context, a address.Address) error {
+	return r.full.WalletSetDefault(ctx, a)
+}
+
+// WalletSign signs through the full node API, as the instance doesn't serve the
+// remote wallet one. Data is always signed as api.MTUnknown.
+func (r remoteWalletClient) WalletSign(ctx context.Context, a address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	return r.full.WalletSign(ctx, a, msg)
 }
 
-func makeWallet(path string) error {
-	localKey, _ := key.GenerateKey(ctypes.KTSecp256k1)
-	return os.WriteFile(path, localKey.KeyInfo.PrivateKey, 0600)
+func (r remoteWalletClient) defaultAddress(ctx context.Context) (address.Address, error) {
+	return r.full.WalletDefaultAddress(ctx)
 }
 
-func loadWallet(path string) (api.Wallet, error) {
-	pk, err := os.ReadFile(path)
+// openWalletClient opens the keystore in --root, or connects to the instance given by --rpc.
+func openWalletClient(cctx *cli.Context) (walletClient, func(), error) {
+	if !cctx.IsSet("rpc") {
+		passphrase, err := loadPassphrase(cctx.String("keystore-passphrase-file"), cctx.Bool("keystore-insecure"))
+		if err != nil {
+			return nil, nil, err
+		}
+		ks, err := openKeystore(path.Join(cctx.String("root"), "keystore"), passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		lw, err := wallet.NewWallet(ks)
+		if err != nil {
+			return nil, nil, err
+		}
+		return localWalletClient{lw}, func() {}, nil
+	}
+
+	info := lotuscliutil.ParseApiInfo(cctx.String("rpc"))
+	addr, err := info.DialArgs("v1")
+	if err != nil {
+		return nil, nil, err
+	}
+	wapi, wcloser, err := lotusclient.NewWalletRPCV0(cctx.Context, addr, info.AuthHeader())
+	if err != nil {
+		return nil, nil, err
+	}
+	full, fcloser, err := lotusclient.NewFullNodeRPCV1(cctx.Context, addr, info.AuthHeader())
 	if err != nil {
-		return nil, err
-	}
-	wk := wallet.NewMemKeyStore()
-	wapi, _ := wallet.NewWallet(wk)
-	wapi.WalletImport(context.Background(), &ctypes.KeyInfo{
-		Type:       ctypes.KTSecp256k1,
-		PrivateKey: pk,
-	})
-	return wapi, nil
+		wcloser()
+		return nil, nil, err
+	}
+	return remoteWalletClient{wapi, full}, func() { wcloser(); fcloser() }, nil
+}
+
+// walletAction runs fn with the wallet the command was pointed at.
+func walletAction(fn func(cctx *cli.Context, w walletClient) error) cli.ActionFunc {
+	return func(cctx *cli.Context) error {
+		w, closer, err := openWalletClient(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+		return fn(cctx, w)
+	}
+}
+
+// addressArg parses the i'th argument as an address.
+func addressArg(cctx *cli.Context, i int) (address.Address, error) {
+	if cctx.NArg() <= i {
+		return address.Undef, fmt.Errorf("missing address argument")
+	}
+	return address.NewFromString(cctx.Args().Get(i))
+}
+
+var walletCmd = &cli.Command{
+	Name:  "wallet",
+	Usage: "manage the keys of the internal wallet",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "rpc",
+			Usage: "API of a running instance to manage, as token:address with an admin token, e.g. <token>:http://127.0.0.1:9091. If unset, the keystore in --root is used directly",
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "new",
+			Usage:     "create a key",
+			ArgsUsage: "[secp256k1|bls]",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				kt := types.KTSecp256k1
+				if cctx.Args().Present() {
+					kt = types.KeyType(cctx.Args().First())
+				}
+				a, err := w.WalletNew(cctx.Context, kt)
+				if err != nil {
+					return err
+				}
+				fmt.Println(a)
+				return nil
+			}),
+		},
+		{
+			Name:  "list",
+			Usage: "list keys, marking the default",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				addrs, err := w.WalletList(cctx.Context)
+				if err != nil {
+					return err
+				}
+				def, _ := w.defaultAddress(cctx.Context)
+				for _, a := range addrs {
+					if a == def {
+						fmt.Printf("%s\t(default)\n", a)
+					} else {
+						fmt.Println(a)
+					}
+				}
+				return nil
+			}),
+		},
+		{
+			Name:      "import",
+			Usage:     "import a hex encoded key, as written by export or lotus wallet export",
+			ArgsUsage: "[file]",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				var in []byte
+				var err error
+				if cctx.Args().Present() {
+					in, err = os.ReadFile(cctx.Args().First())
+				} else {
+					in, err = io.ReadAll(os.Stdin)
+				}
+				if err != nil {
+					return err
+				}
+				b, err := hex.DecodeString(strings.TrimSpace(string(in)))
+				if err != nil {
+					return fmt.Errorf("key is not hex encoded: %w", err)
+				}
+				var ki types.KeyInfo
+				if err := json.Unmarshal(b, &ki); err != nil {
+					return err
+				}
+				a, err := w.WalletImport(cctx.Context, &ki)
+				if err != nil {
+					return err
+				}
+				fmt.Println(a)
+				return nil
+			}),
+		},
+		{
+			Name:      "export",
+			Usage:     "print a key, hex encoded",
+			ArgsUsage: "<address>",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				a, err := addressArg(cctx, 0)
+				if err != nil {
+					return err
+				}
+				ki, err := w.WalletExport(cctx.Context, a)
+				if err != nil {
+					return err
+				}
+				b, err := json.Marshal(ki)
+				if err != nil {
+					return err
+				}
+				fmt.Println(hex.EncodeToString(b))
+				return nil
+			}),
+		},
+		{
+			Name:      "delete",
+			Usage:     "delete a key",
+			ArgsUsage: "<address>",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				a, err := addressArg(cctx, 0)
+				if err != nil {
+					return err
+				}
+				return w.WalletDelete(cctx.Context, a)
+			}),
+		},
+		{
+			Name:      "set-default",
+			Usage:     "set the default key, which new miner identities use as their worker",
+			ArgsUsage: "<address>",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				a, err := addressArg(cctx, 0)
+				if err != nil {
+					return err
+				}
+				return w.WalletSetDefault(cctx.Context, a)
+			}),
+		},
+		{
+			Name:      "sign",
+			Usage:     "sign a hex encoded message",
+			ArgsUsage: "<address> <hex message>",
+			Action: walletAction(func(cctx *cli.Context, w walletClient) error {
+				a, err := addressArg(cctx, 0)
+				if err != nil {
+					return err
+				}
+				msg, err := hex.DecodeString(cctx.Args().Get(1))
+				if err != nil {
+					return err
+				}
+				sig, err := w.WalletSign(cctx.Context, a, msg, api.MsgMeta{Type: api.MTUnknown})
+				if err != nil {
+					return err
+				}
+				b, err := sig.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				fmt.Println(hex.EncodeToString(b))
+				return nil
+			}),
+		},
+		{
+			Name:      "verify",
+			Usage:     "check a hex encoded signature, as printed by sign",
+			ArgsUsage: "<address> <hex message> <hex signature>",
+			Action: func(cctx *cli.Context) error {
+				a, err := addressArg(cctx, 0)
+				if err != nil {
+					return err
+				}
+				msg, err := hex.DecodeString(cctx.Args().Get(1))
+				if err != nil {
+					return err
+				}
+				b, err := hex.DecodeString(cctx.Args().Get(2))
+				if err != nil {
+					return err
+				}
+				var sig crypto.Signature
+				if err := sig.UnmarshalBinary(b); err != nil {
+					return err
+				}
+				if err := sigs.Verify(&sig, a, msg); err != nil {
+					fmt.Printf("invalid: %s\n", err)
+					return cli.Exit("", 1)
+				}
+				fmt.Println("valid")
+				return nil
+			},
+		},
+	},
 }
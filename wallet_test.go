@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+)
+
+func TestWalletDefaultAddress(t *testing.T) {
+	ctx := context.Background()
+	worker, _ := address.NewIDAddress(3000)
+	lw := newTestWallet(t)
+	sh := &StorageHandler{wallet: lw, miner: &minerIdentity{Worker: worker}}
+	assertDefault(t, sh, worker)
+
+	a, _ := lw.WalletNew(ctx, types.KTSecp256k1)
+	b, _ := lw.WalletNew(ctx, types.KTSecp256k1)
+	lw.SetDefault(a)
+	assertDefault(t, sh, a)
+	if err := sh.WalletSetDefault(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	assertDefault(t, sh, b)
+
+	// a wallet other than the internal one has no default of its own.
+	sh.wallet = &api.WalletStruct{}
+	assertDefault(t, sh, worker)
+}
+
+// assertDefault checks sh's default address is want, and that the wallet
+// command shows the same default locally as over RPC.
+func assertDefault(t *testing.T, sh *StorageHandler, want address.Address) {
+	t.Helper()
+	ctx := context.Background()
+	got, err := sh.WalletDefaultAddress(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("default address %s, want %s", got, want)
+	}
+	if lw, ok := sh.wallet.(*wallet.LocalWallet); ok && want != sh.miner.Worker {
+		local, err := localWalletClient{lw}.defaultAddress(ctx)
+		if err != nil || local != got {
+			t.Fatalf("wallet list shows %s as default, RPC %s: %v", local, got, err)
+		}
+	}
+}
+
+func newTestWallet(t *testing.T) *wallet.LocalWallet {
+	t.Helper()
+	ks, err := openKeystore(t.TempDir(), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lw, err := wallet.NewWallet(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lw
+}